@@ -4,48 +4,45 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
-	"github.com/google/uuid"
 )
 
 // Archive extracts uploaded archives to the project directory.
 // It handles both ZIP and TAR.GZ formats.
-// Files are extracted to the same destination structure as Git clones:
-// {DOWNLOAD_PATH}/{organization_id}/projects/{project_id}/{branch}
-func Archive(analysis codeclarity.Analysis, project codeclarity.Project, organization uuid.UUID) error {
-	path := os.Getenv("DOWNLOAD_PATH")
-	if path == "" {
-		path = "/private"
-	}
-
+// The archive is searched for under the download root and extracted to destination,
+// the workspace given by the WorkspaceLayout like for Git clones.
+// It returns the content hash of the archive, "sha256:<hex>", which identifies the uploaded sources
+// the same way a commit identifies the sources of a git project.
+// The extraction stops as soon as ctx is done, progress is told about the files extracted.
+func Archive(ctx context.Context, project codeclarity.Project, root string, destination string, progress ProgressFunc) (string, error) {
 	// Find the uploaded archive file
 	// Files are stored at: {DOWNLOAD_PATH}/{user_id}/{project_id}/{filename}
-	sourcePath, err := findUploadedArchive(path, project)
+	sourcePath, err := findUploadedArchive(root, project)
 	if err != nil {
-		return fmt.Errorf("failed to find uploaded archive: %w", err)
+		return "", fmt.Errorf("failed to find uploaded archive: %w", err)
 	}
 
 	log.Printf("Found uploaded archive at: %s", sourcePath)
 
-	// Destination: same structure as Git clones
-	// {DOWNLOAD_PATH}/{organization_id}/projects/{project_id}/{branch}
-	branch := analysis.Branch
-	if branch == "" {
-		branch = "main" // Default branch name for FILE projects
+	digest, err := hashFile(ctx, sourcePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash archive: %w", err)
 	}
 
-	destination := filepath.Join(path, organization.String(), "projects", project.Id.String(), branch)
-
 	// Create destination directory
 	if err := os.MkdirAll(destination, 0755); err != nil {
-		return fmt.Errorf("failed to create destination directory: %w", err)
+		return "", fmt.Errorf("failed to create destination directory: %w", err)
 	}
 
 	log.Printf("Extracting archive to: %s", destination)
@@ -53,12 +50,74 @@ func Archive(analysis codeclarity.Analysis, project codeclarity.Project, organiz
 	// Detect format and extract
 	lowerPath := strings.ToLower(sourcePath)
 	if strings.HasSuffix(lowerPath, ".zip") {
-		return extractZip(sourcePath, destination)
+		return digest, extractZip(ctx, sourcePath, destination, progress)
 	} else if strings.HasSuffix(lowerPath, ".tar.gz") || strings.HasSuffix(lowerPath, ".tgz") {
-		return extractTarGz(sourcePath, destination)
+		return digest, extractTarGz(ctx, sourcePath, destination, progress)
+	}
+
+	return "", fmt.Errorf("unsupported archive format: %s", sourcePath)
+}
+
+// hashFile returns the SHA-256 digest of the file at path, formatted as "sha256:<hex>".
+func hashFile(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, contextReader{ctx: ctx, r: file}); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// archiveFetcher is the SourceFetcher for FILE projects, whose sources are uploaded as an archive.
+type archiveFetcher struct {
+	layout  WorkspaceLayout
+	locker  WorkspaceLocker
+	timeout time.Duration
+}
+
+// RequiresIntegration implements SourceFetcher, uploaded archives are read from local storage.
+func (archiveFetcher) RequiresIntegration() bool {
+	return false
+}
+
+// Fetch implements SourceFetcher by extracting the uploaded archive with Archive.
+func (f archiveFetcher) Fetch(ctx context.Context, req FetchRequest) (FetchResult, error) {
+	ref, destination, err := f.layout.Workspace(req)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	unlock, err := lockWorkspaces(ctx, f.locker, StageExtract, destination)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	defer unlock()
+
+	extractCtx, cancel := withStageTimeout(ctx, f.timeout)
+	defer cancel()
+	req.Progress.report(PhaseExtracting, Progress{})
+	digest, err := Archive(extractCtx, req.Project, f.layout.Root, destination, req.Progress)
+	if err != nil {
+		if isCanceled(ctx) {
+			discardCanceledWorkspace(f.layout, req, ref, destination)
+		}
+		return FetchResult{}, timedOut(extractCtx, StageExtract, newDownloadError(StageExtract, CodeExtractFailed, fmt.Errorf("failed to extract archive: %w", err)))
+	}
+	if err := f.layout.AddReference(req.Organization, req.Project.Id, ref, req.Analysis.Id); err != nil {
+		// The workspace is usable, it will only be kept when the analysis is deleted
+		log.Printf("Failed to record the reference of analysis %s to %s: %v", req.Analysis.Id, destination, err)
 	}
 
-	return fmt.Errorf("unsupported archive format: %s", sourcePath)
+	return FetchResult{
+		Path:     destination,
+		Source:   SourceArchive,
+		Revision: digest,
+		Metadata: map[string]string{"ref": ref},
+	}, nil
 }
 
 // findUploadedArchive searches for the uploaded archive file in the project directory.
@@ -121,8 +180,9 @@ func findArchiveInDirectory(dirPath string) (string, error) {
 	return "", fmt.Errorf("no archive found in directory %s", dirPath)
 }
 
-// extractZip extracts a ZIP archive to the destination directory.
-func extractZip(src, dest string) error {
+// extractZip extracts a ZIP archive to the destination directory, reporting each file to progress.
+// It stops with the error of ctx once it is done.
+func extractZip(ctx context.Context, src, dest string, progress ProgressFunc) error {
 	r, err := zip.OpenReader(src)
 	if err != nil {
 		return fmt.Errorf("failed to open zip file: %w", err)
@@ -132,7 +192,14 @@ func extractZip(src, dest string) error {
 	// Determine if there's a single top-level directory to strip
 	stripPrefix := detectSingleRootDir(r.File)
 
+	extracted := Progress{Total: int64(len(r.File))}
 	for _, f := range r.File {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		extracted.Count++
+		extracted.Percent = int(extracted.Count * 100 / extracted.Total)
+
 		// Get the path, potentially stripping the root directory
 		fpath := f.Name
 		if stripPrefix != "" && strings.HasPrefix(fpath, stripPrefix) {
@@ -172,21 +239,24 @@ func extractZip(src, dest string) error {
 			return err
 		}
 
-		_, err = io.Copy(outFile, rc)
+		written, err := io.Copy(outFile, contextReader{ctx: ctx, r: rc})
 		outFile.Close()
 		rc.Close()
 
 		if err != nil {
 			return err
 		}
+		extracted.Bytes += written
+		progress.report(PhaseExtracting, extracted)
 	}
 
 	log.Printf("Successfully extracted ZIP archive: %d files", len(r.File))
 	return nil
 }
 
-// extractTarGz extracts a TAR.GZ archive to the destination directory.
-func extractTarGz(src, dest string) error {
+// extractTarGz extracts a TAR.GZ archive to the destination directory, reporting each file to progress.
+// The number of files is not known beforehand. It stops with the error of ctx once it is done.
+func extractTarGz(ctx context.Context, src, dest string, progress ProgressFunc) error {
 	file, err := os.Open(src)
 	if err != nil {
 		return fmt.Errorf("failed to open tar.gz file: %w", err)
@@ -204,7 +274,7 @@ func extractTarGz(src, dest string) error {
 	// First pass: detect if there's a single root directory
 	file.Seek(0, 0)
 	gzrDetect, _ := gzip.NewReader(file)
-	trDetect := tar.NewReader(gzrDetect)
+	trDetect := tar.NewReader(contextReader{ctx: ctx, r: gzrDetect})
 	stripPrefix := detectSingleRootDirTar(trDetect)
 	gzrDetect.Close()
 
@@ -218,7 +288,12 @@ func extractTarGz(src, dest string) error {
 	tr = tar.NewReader(gzr2)
 
 	fileCount := 0
+	var extracted Progress
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
@@ -259,12 +334,16 @@ func extractTarGz(src, dest string) error {
 				return err
 			}
 
-			if _, err := io.Copy(outFile, tr); err != nil {
+			written, err := io.Copy(outFile, contextReader{ctx: ctx, r: tr})
+			if err != nil {
 				outFile.Close()
 				return err
 			}
 			outFile.Close()
 			fileCount++
+			extracted.Count++
+			extracted.Bytes += written
+			progress.report(PhaseExtracting, extracted)
 		}
 	}
 
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// cancelExchange is the fanout exchange on which canceled analyses are announced, see the README for its contract.
+// Every replica binds a queue of its own to it, since any of them may be downloading the analysis.
+// Announcements only abort downloads sooner, the status of the analysis is checked in any case.
+const cancelExchange = "analysis_cancel"
+
+// analysisCanceled is the status the API gives to canceled analyses.
+// The downloader checks it once the analysis is looked up and again before publishing its result.
+const analysisCanceled codeclarity.AnalysisStatus = "canceled"
+
+// canceledRetention is how long a cancellation is remembered, so that an analysis canceled
+// while its message is still queued or waiting for a retry is not downloaded afterwards.
+const canceledRetention = time.Hour
+
+// ErrAnalysisCanceled is the cause of the context of a download whose analysis was canceled.
+var ErrAnalysisCanceled = errors.New("analysis canceled")
+
+// cancelRegistry tracks the downloads in progress so that they can be canceled.
+// A nil cancelRegistry never cancels anything.
+type cancelRegistry struct {
+	mu       sync.Mutex
+	running  map[uuid.UUID]context.CancelCauseFunc
+	canceled map[uuid.UUID]time.Time
+}
+
+// newCancelRegistry creates an empty cancelRegistry.
+func newCancelRegistry() *cancelRegistry {
+	return &cancelRegistry{
+		running:  make(map[uuid.UUID]context.CancelCauseFunc),
+		canceled: make(map[uuid.UUID]time.Time),
+	}
+}
+
+// start returns the context to download analysis with, and the function to call once it is done.
+// The context is canceled with ErrAnalysisCanceled when the analysis is, or already was, canceled.
+func (r *cancelRegistry) start(ctx context.Context, analysis uuid.UUID) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	if r == nil {
+		return ctx, func() { cancel(nil) }
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.canceled[analysis]; ok {
+		cancel(ErrAnalysisCanceled)
+	}
+	r.running[analysis] = cancel
+	return ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.running, analysis)
+		cancel(nil)
+	}
+}
+
+// cancel aborts the download of analysis if it is running, and skips it if it is started later.
+func (r *cancelRegistry) cancel(analysis uuid.UUID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, at := range r.canceled {
+		if now.Sub(at) > canceledRetention {
+			delete(r.canceled, id)
+		}
+	}
+	r.canceled[analysis] = now
+
+	if cancel, ok := r.running[analysis]; ok {
+		log.Printf("Canceling the download of analysis %s", analysis)
+		cancel(ErrAnalysisCanceled)
+	}
+}
+
+// isCanceled reports whether ctx was canceled because its analysis was.
+func isCanceled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrAnalysisCanceled)
+}
+
+// canceledInStore reports whether the analysis has the analysisCanceled status in the store of p.
+// An analysis that cannot be looked up is not considered canceled, its download goes on.
+func canceledInStore(ctx context.Context, p *pipeline, analysis uuid.UUID) bool {
+	lookupCtx, cancel := withStageTimeout(ctx, p.timeouts.Lookup)
+	defer cancel()
+	info, err := p.store.GetAnalysis(lookupCtx, analysis)
+	return err == nil && info.Status == analysisCanceled
+}
+
+// discardCanceledWorkspace removes the partial workspace a canceled analysis was downloading into,
+// unless other analyses use it, in which case it is reset by their next download.
+// The workspace must be locked.
+func discardCanceledWorkspace(layout WorkspaceLayout, req FetchRequest, ref string, destination string) {
+	if layout.IsReferenced(req.Organization, req.Project.Id, ref) {
+		return
+	}
+	log.Printf("Removing workspace %s of canceled analysis %s", destination, req.Analysis.Id)
+	if err := removeWorkspace(layout.MirrorPath(req.Organization, req.Project.Id), destination); err != nil {
+		log.Printf("Failed to remove workspace %s: %v", destination, err)
+	}
+}
+
+// subscribeCancellations cancels the analyses announced on the cancelExchange of the broker at url.
+// It reconnects whenever the connection is lost and never returns.
+func subscribeCancellations(url string, registry *cancelRegistry) {
+	keepConnected(url, "consumer of "+cancelExchange, func(ch *amqp.Channel) error {
+		if err := ch.ExchangeDeclare(cancelExchange, "fanout", true, false, false, false, nil); err != nil {
+			return fmt.Errorf("failed to declare exchange: %w", err)
+		}
+		// A queue of this replica only, deleted with the connection
+		q, err := ch.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to declare queue: %w", err)
+		}
+		if err := ch.QueueBind(q.Name, "", cancelExchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind queue: %w", err)
+		}
+		deliveries, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to register consumer: %w", err)
+		}
+
+		log.Printf("Started listening on exchange: %s", cancelExchange)
+		for d := range deliveries {
+			var message AnalysisCancelMessage
+			if err := json.Unmarshal(d.Body, &message); err != nil {
+				log.Printf("Failed to decode cancel message: %v", err)
+				continue
+			}
+			registry.cancel(message.AnalysisId)
+		}
+		return fmt.Errorf("consumer stopped")
+	})
+}
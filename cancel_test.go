@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCancelRegistry(t *testing.T) {
+	registry := newCancelRegistry()
+	running, canceledBefore, other := uuid.New(), uuid.New(), uuid.New()
+
+	ctx, done := registry.start(context.Background(), running)
+	defer done()
+	registry.cancel(running)
+	if !isCanceled(ctx) {
+		t.Error("running download was not canceled")
+	}
+
+	registry.cancel(canceledBefore)
+	ctx, done = registry.start(context.Background(), canceledBefore)
+	defer done()
+	if !isCanceled(ctx) {
+		t.Error("download of an analysis canceled before it started was not canceled")
+	}
+
+	ctx, done = registry.start(context.Background(), other)
+	done()
+	if ctx.Err() == nil || isCanceled(ctx) {
+		t.Errorf("finished download cause = %v, want %v", context.Cause(ctx), context.Canceled)
+	}
+
+	var none *cancelRegistry
+	ctx, done = none.start(context.Background(), other)
+	defer done()
+	if ctx.Err() != nil {
+		t.Errorf("nil registry context error = %v, want none", ctx.Err())
+	}
+}
+
+func TestDispatchCanceledDuringClone(t *testing.T) {
+	// Skips the test when git is not installed
+	newFixtureRepo(t, nil)
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+
+	// A git daemon that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	store := NewMemoryStore()
+	project := codeclarity.Project{Id: uuid.New(), Type: "GITHUB", Url: "git://" + listener.Addr().String() + "/project.git"}
+	integration := codeclarity.Integration{Id: uuid.New(), AccessToken: testToken}
+	analysis := codeclarity.Analysis{Id: uuid.New(), OrganizationId: uuid.New(), ProjectId: &project.Id, Branch: "main"}
+	store.AddProject(project)
+	store.AddIntegration(integration)
+	store.AddAnalysis(analysis)
+
+	publisher := newRecordingPublisher()
+	registry := newCancelRegistry()
+	p := newTestPipeline(t, withStore(store), withPublisher(publisher), withCancellations(registry))
+	body, _ := json.Marshal(types_amqp.DispatcherDownloaderMessage{
+		AnalysisId:     analysis.Id,
+		ProjectId:      project.Id,
+		IntegrationId:  integration.Id,
+		OrganizationId: analysis.OrganizationId,
+	})
+
+	time.AfterFunc(300*time.Millisecond, func() { registry.cancel(analysis.Id) })
+	start := time.Now()
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+		t.Errorf("dispatch() = %v, want %v", action, actionAck)
+	}
+	if elapsed := time.Since(start); elapsed > gitWaitDelay+5*time.Second {
+		t.Errorf("dispatch() took %v to stop", elapsed)
+	}
+	if sent := publisher.sent("downloader_dispatcher"); len(sent) != 0 {
+		t.Errorf("got %d messages on downloader_dispatcher, want none", len(sent))
+	}
+	if sent := publisher.sent(failureQueue); len(sent) != 0 {
+		t.Errorf("got %d messages on %s, want none", len(sent), failureQueue)
+	}
+
+	destination, err := NewWorkspaceLayout().Path(analysis.OrganizationId, project.Id, branchRef("main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(destination); !os.IsNotExist(err) {
+		t.Errorf("workspace %s of the canceled analysis was kept", destination)
+	}
+
+	// A redelivery of the canceled analysis is not downloaded again
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+		t.Errorf("dispatch() = %v, want %v", action, actionAck)
+	}
+	if sent := publisher.sent(failureQueue); len(sent) != 0 {
+		t.Errorf("got %d messages on %s after redelivery, want none", len(sent), failureQueue)
+	}
+}
+
+// cancelingStore is a MemoryStore whose analyses are canceled after a number of lookups.
+type cancelingStore struct {
+	*MemoryStore
+	mu      sync.Mutex
+	lookups int
+	after   int
+}
+
+func (s *cancelingStore) GetAnalysis(ctx context.Context, analysisID uuid.UUID) (codeclarity.Analysis, error) {
+	analysis, err := s.MemoryStore.GetAnalysis(ctx, analysisID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lookups++; s.lookups > s.after {
+		analysis.Status = analysisCanceled
+	}
+	return analysis, err
+}
+
+func TestDispatchCanceledAnalysis(t *testing.T) {
+	var tests = []struct {
+		name string
+		// after is the number of lookups of the analysis before it is canceled
+		after int
+	}{
+		{"before the download", 0},
+		{"during the download", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			t.Setenv("DOWNLOAD_PATH", root)
+
+			store := &cancelingStore{MemoryStore: NewMemoryStore(), after: tt.after}
+			message := newFileProjectFixture(t, store.MemoryStore, root, "", "", map[string]string{"package.json": `{}`})
+			body, _ := json.Marshal(message)
+			publisher := newRecordingPublisher()
+			p := newTestPipeline(t, withStore(store), withPublisher(publisher))
+
+			if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+				t.Errorf("dispatch() = %v, want %v", action, actionAck)
+			}
+			if n := len(publisher.sent("downloader_dispatcher")) + len(publisher.sent(failureQueue)); n != 0 {
+				t.Errorf("got %d messages for a canceled analysis, want none", n)
+			}
+			if store.lookups != tt.after+1 {
+				t.Errorf("looked the analysis up %d times, want %d", store.lookups, tt.after+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// defaultSweepInterval is the time between two sweeps of the workspaces, unless configured otherwise.
+const defaultSweepInterval = time.Hour
+
+// sweepWorkspaces runs sweep every interval, forever.
+// Nothing announces the deletion of analyses, so their workspaces are found by checking
+// every reference against the database.
+func sweepWorkspaces(layout WorkspaceLayout, locker WorkspaceLocker, store ProjectStore, lookupTimeout time.Duration, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := sweep(context.Background(), layout, locker, store, lookupTimeout); err != nil {
+			log.Printf("Failed to sweep the workspaces: %v", err)
+		}
+	}
+}
+
+// sweep releases the references of the analyses that no longer exist in store
+// and removes the workspaces no analysis uses anymore.
+// It stops at the first failed lookup, the analysis may still exist.
+func sweep(ctx context.Context, layout WorkspaceLayout, locker WorkspaceLocker, store ProjectStore, lookupTimeout time.Duration) error {
+	markers, err := filepath.Glob(filepath.Join(layout.Root, "*", "projects", "*", ".references", "*", "*"))
+	if err != nil {
+		return err
+	}
+
+	checked := make(map[uuid.UUID]bool)
+	for _, marker := range markers {
+		// <organization>/projects/<project>/.references/<ref>/<analysis>
+		rel, _ := filepath.Rel(layout.Root, marker)
+		parts := strings.Split(rel, string(filepath.Separator))
+		organization, organizationErr := uuid.Parse(parts[0])
+		project, projectErr := uuid.Parse(parts[2])
+		analysis, analysisErr := uuid.Parse(parts[5])
+		if organizationErr != nil || projectErr != nil || analysisErr != nil || checked[analysis] {
+			continue
+		}
+		checked[analysis] = true
+
+		lookupCtx, cancel := withStageTimeout(ctx, lookupTimeout)
+		_, err := store.GetAnalysis(lookupCtx, analysis)
+		cancel()
+		if !errors.Is(err, ErrNotFound) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		log.Printf("Releasing the workspaces of deleted analysis %s", analysis)
+		if err := cleanupAnalysis(layout, locker, organization, project, analysis); err != nil {
+			return fmt.Errorf("failed to clean up the workspaces of analysis %s: %w", analysis, err)
+		}
+	}
+	return nil
+}
+
+// cleanupAnalysis releases the workspaces of a project used by a deleted analysis
+// and removes those no other analysis uses anymore, once no download is writing to them.
+func cleanupAnalysis(layout WorkspaceLayout, locker WorkspaceLocker, organization uuid.UUID, project uuid.UUID, analysis uuid.UUID) error {
+	orphans, err := layout.ReleaseReferences(organization, project, analysis)
+	if err != nil {
+		return err
+	}
+
+	mirror := layout.MirrorPath(organization, project)
+	for _, ref := range orphans {
+		path, err := layout.Path(organization, project, ref)
+		if err != nil {
+			return err
+		}
+		if err := removeUnusedWorkspace(layout, locker, organization, project, ref, mirror, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeUnusedWorkspace removes the workspace at path unless a download started using it again
+// since its references were released.
+func removeUnusedWorkspace(layout WorkspaceLayout, locker WorkspaceLocker, organization uuid.UUID, project uuid.UUID, ref string, mirror string, path string) error {
+	unlock, err := lockWorkspaces(context.Background(), locker, StageClone, mirror, path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if layout.IsReferenced(organization, project, ref) {
+		return nil
+	}
+	log.Printf("Removing workspace %s, no analysis uses it anymore", path)
+	return removeWorkspace(mirror, path)
+}
+
+// removeWorkspace deletes the workspace at path, unregistering it from mirror if it is one of its worktrees.
+func removeWorkspace(mirror string, path string) error {
+	git := &gitSession{}
+	if git.isWorktreeOf(path, mirror) && git.run(mirror, "worktree", "remove", "--force", path) == nil {
+		return nil
+	}
+
+	// Worktrees with submodules cannot be removed by git, their registration is pruned instead
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to remove workspace: %w", err)
+	}
+	if _, err := os.Stat(mirror); err == nil {
+		if err := git.run(mirror, "worktree", "prune"); err != nil {
+			return fmt.Errorf("git worktree prune failed: %w", err)
+		}
+	}
+	return nil
+}
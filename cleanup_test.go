@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+func TestSweepReleasesDeletedAnalyses(t *testing.T) {
+	layout := WorkspaceLayout{Root: t.TempDir()}
+	organization, project := uuid.New(), uuid.New()
+	store := NewMemoryStore()
+	kept := codeclarity.Analysis{Id: uuid.New(), OrganizationId: organization, ProjectId: &project}
+	store.AddAnalysis(kept)
+	deleted := uuid.New()
+
+	paths := make(map[string]string)
+	for ref, analyses := range map[string][]uuid.UUID{
+		branchRef("main"):  {kept.Id, deleted},
+		commitRef("abc12"): {deleted},
+	} {
+		path, err := layout.Path(organization, project, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		paths[ref] = path
+		for _, analysis := range analyses {
+			if err := layout.AddReference(organization, project, ref, analysis); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Entries not laid out by the downloader are left alone
+	if err := os.MkdirAll(filepath.Join(layout.ProjectRoot(organization, project), ".references", "stray", "not-an-analysis"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database cannot tell whether the analysis was deleted, nothing is removed
+	if err := sweep(context.Background(), layout, FileLocker{}, unreachableStore{}, time.Second); err == nil {
+		t.Error("sweep() succeeded without a database")
+	}
+	if !fileExists(paths[commitRef("abc12")]) {
+		t.Fatal("workspace removed while the database was down")
+	}
+
+	if err := sweep(context.Background(), layout, FileLocker{}, store, time.Second); err != nil {
+		t.Fatalf("sweep() error = %v", err)
+	}
+	if fileExists(paths[commitRef("abc12")]) {
+		t.Error("workspace of the deleted analysis was not removed")
+	}
+	if !fileExists(paths[branchRef("main")]) || !layout.IsReferenced(organization, project, branchRef("main")) {
+		t.Error("workspace still used by an analysis was removed")
+	}
+}
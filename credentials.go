@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+)
+
+// askPassScript answers the username and password prompts of git from the environment
+// of the git invocation, so the credentials are never written to disk.
+const askPassScript = `#!/bin/sh
+case "$1" in
+	Username*) printf '%s\n' "$DOWNLOADER_GIT_USERNAME" ;;
+	*) printf '%s\n' "$DOWNLOADER_GIT_PASSWORD" ;;
+esac
+`
+
+// gitCredentials are used to authenticate against the remote of a project.
+type gitCredentials struct {
+	Username string
+	Password string
+}
+
+// credentialsFor returns the credentials to clone project with the access token of integration.
+// GitLab expects OAuth tokens with the "oauth2" user, GitHub accepts any user with a token as password.
+func credentialsFor(project codeclarity.Project, integration codeclarity.Integration) gitCredentials {
+	username := "x-access-token"
+	if strings.EqualFold(project.Type, "GITLAB") || strings.Contains(project.Url, "gitlab") {
+		username = "oauth2"
+	}
+	return gitCredentials{Username: username, Password: integration.AccessToken}
+}
+
+// askPass is an ephemeral GIT_ASKPASS helper.
+// The helper script lives outside the workspace and the credentials are only passed
+// in the environment of the git commands using it.
+type askPass struct {
+	dir         string
+	credentials gitCredentials
+}
+
+// newAskPass creates the helper for credentials. It must be closed once git is done.
+// It returns nil if there are no credentials to provide.
+func newAskPass(credentials gitCredentials) (*askPass, error) {
+	if credentials.Password == "" {
+		return nil, nil
+	}
+
+	dir, err := os.MkdirTemp("", "downloader-askpass-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create askpass directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "askpass.sh"), []byte(askPassScript), 0700); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to write askpass helper: %w", err)
+	}
+	return &askPass{dir: dir, credentials: credentials}, nil
+}
+
+// Env returns the environment variables making git use the helper.
+// A nil askPass only disables interactive prompts.
+func (a *askPass) Env() []string {
+	env := []string{"GIT_TERMINAL_PROMPT=0"}
+	if a == nil {
+		return env
+	}
+	return append(env,
+		"GIT_ASKPASS="+filepath.Join(a.dir, "askpass.sh"),
+		"DOWNLOADER_GIT_USERNAME="+a.credentials.Username,
+		"DOWNLOADER_GIT_PASSWORD="+a.credentials.Password,
+	)
+}
+
+// Close removes the helper script.
+func (a *askPass) Close() error {
+	if a == nil {
+		return nil
+	}
+	return os.RemoveAll(a.dir)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// messageVersionHeader carries the version of the format of a dispatcher message.
+// Messages without it predate versioning and are of defaultMessageVersion.
+const messageVersionHeader = "x-message-version"
+
+// defaultMessageVersion is the version of the messages without a messageVersionHeader.
+const defaultMessageVersion = "1"
+
+var (
+	// ErrUnsupportedVersion is returned for messages of a version no decoder handles.
+	ErrUnsupportedVersion = errors.New("unsupported message version")
+	// ErrMissingField is returned for messages lacking a required field.
+	ErrMissingField = errors.New("missing required field")
+)
+
+// dispatcherMessageDecoders decode each supported version of the dispatcher messages.
+var dispatcherMessageDecoders = map[string]func(body []byte) (types_amqp.DispatcherDownloaderMessage, error){
+	"1": decodeDispatcherMessageV1,
+}
+
+// decodeDispatcherMessage decodes and validates the dispatcher message in d with the decoder of its version.
+// Failures are reported as a DownloadError of StageDecode, along with whatever could be decoded.
+func decodeDispatcherMessage(d amqp.Delivery) (types_amqp.DispatcherDownloaderMessage, error) {
+	version, err := messageVersion(d)
+	if err != nil {
+		return types_amqp.DispatcherDownloaderMessage{}, newDownloadError(StageDecode, CodeUnsupportedVersion, err)
+	}
+	decode, ok := dispatcherMessageDecoders[version]
+	if !ok {
+		return types_amqp.DispatcherDownloaderMessage{}, newDownloadError(StageDecode, CodeUnsupportedVersion, fmt.Errorf("%w %q", ErrUnsupportedVersion, version))
+	}
+
+	message, err := decode(d.Body)
+	if err != nil {
+		return message, newDownloadError(StageDecode, CodeMalformedMessage, err)
+	}
+	if err := validateDispatcherMessage(message); err != nil {
+		return message, newDownloadError(StageDecode, CodeInvalidMessage, err)
+	}
+	return message, nil
+}
+
+// messageVersion returns the version in the messageVersionHeader of d, or defaultMessageVersion.
+func messageVersion(d amqp.Delivery) (string, error) {
+	switch version := d.Headers[messageVersionHeader].(type) {
+	case nil:
+		return defaultMessageVersion, nil
+	case string:
+		return strings.TrimSpace(version), nil
+	case int8, int16, int32, int64, int, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(version), nil
+	default:
+		return "", fmt.Errorf("%w: header %s is a %T", ErrUnsupportedVersion, messageVersionHeader, version)
+	}
+}
+
+// decodeDispatcherMessageV1 decodes the first version of the dispatcher messages,
+// which holds the IDs of the analysis, project, integration and organization.
+func decodeDispatcherMessageV1(body []byte) (types_amqp.DispatcherDownloaderMessage, error) {
+	var message types_amqp.DispatcherDownloaderMessage
+	err := decodeStrict(body, &message)
+	return message, err
+}
+
+// decodeStrict decodes the single JSON value in body into v, failing on fields v does not have.
+func decodeStrict(body []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("unexpected data after the message")
+	}
+	return nil
+}
+
+// validateDispatcherMessage checks that the IDs every message needs are set.
+// The integration is optional, uploaded projects do not have one.
+func validateDispatcherMessage(message types_amqp.DispatcherDownloaderMessage) error {
+	var missing []string
+	for _, field := range []struct {
+		name string
+		id   uuid.UUID
+	}{
+		{"analysis_id", message.AnalysisId},
+		{"project_id", message.ProjectId},
+		{"organization_id", message.OrganizationId},
+	} {
+		if field.id == uuid.Nil {
+			missing = append(missing, field.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingField, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the decoding tests")
+
+// decodeResult is what the golden files record of the decoding of a message.
+type decodeResult struct {
+	Message *types_amqp.DispatcherDownloaderMessage `json:"message,omitempty"`
+	Stage   DownloadStage                           `json:"stage,omitempty"`
+	Code    FailureCode                             `json:"code,omitempty"`
+	Error   string                                  `json:"error,omitempty"`
+}
+
+// TestDecodeDispatcherMessageGolden decodes every message in testdata/dispatcher_downloader/<version>,
+// with the version in its header ("unversioned" has none), and compares the result with its .golden file.
+// Run the tests with -update to rewrite the golden files.
+func TestDecodeDispatcherMessageGolden(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "dispatcher_downloader", "*", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no messages in testdata/dispatcher_downloader")
+	}
+	// Every supported version has golden files, unsupported ones only have messages that are rejected
+	for version := range dispatcherMessageDecoders {
+		if _, err := os.Stat(filepath.Join("testdata", "dispatcher_downloader", "v"+version, "valid.json")); err != nil {
+			t.Errorf("no valid message of the supported version %s: %v", version, err)
+		}
+	}
+	for _, file := range files {
+		version := filepath.Base(filepath.Dir(file))
+		name := strings.TrimSuffix(filepath.Base(file), ".json")
+		t.Run(version+"/"+name, func(t *testing.T) {
+			body, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := amqp.Delivery{Body: body}
+			if version != "unversioned" {
+				d.Headers = amqp.Table{messageVersionHeader: strings.TrimPrefix(version, "v")}
+			}
+
+			var result decodeResult
+			message, err := decodeDispatcherMessage(d)
+			var downloadErr *DownloadError
+			switch {
+			case err == nil:
+				result.Message = &message
+			case errors.As(err, &downloadErr):
+				result.Stage, result.Code, result.Error = downloadErr.Stage, downloadErr.Code, err.Error()
+			default:
+				t.Fatalf("decodeDispatcherMessage() error = %v, want a DownloadError", err)
+			}
+			got, _ := json.MarshalIndent(result, "", "\t")
+			got = append(got, '\n')
+
+			golden := strings.TrimSuffix(file, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run with -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded %s as\n%s\nwant\n%s", file, got, want)
+			}
+		})
+	}
+}
+
+func TestMessageVersion(t *testing.T) {
+	var tests = []struct {
+		header any
+		want   string
+		ok     bool
+	}{
+		{nil, defaultMessageVersion, true},
+		{"1", "1", true},
+		{" 2 ", "2", true},
+		{int32(1), "1", true},
+		{int64(3), "3", true},
+		{1.5, "", false},
+	}
+	for _, tt := range tests {
+		d := amqp.Delivery{Headers: amqp.Table{}}
+		if tt.header != nil {
+			d.Headers[messageVersionHeader] = tt.header
+		}
+		got, err := messageVersion(d)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("messageVersion(%v) = %q, %v, want %q", tt.header, got, err, tt.want)
+		}
+	}
+}
+
+func TestDispatchDeadLettersInvalidMessage(t *testing.T) {
+	analysis := uuid.New()
+	body, _ := json.Marshal(map[string]any{"analysis_id": analysis, "project": uuid.New()})
+	publisher := newRecordingPublisher()
+	p := newTestPipeline(t, withPublisher(publisher))
+
+	if action := dispatch(t.Context(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionReject {
+		t.Errorf("dispatch() = %v, want %v", action, actionReject)
+	}
+
+	var failure DownloaderFailureMessage
+	if sent := publisher.sent(failureQueue); len(sent) != 1 {
+		t.Fatalf("got %d failure messages, want 1", len(sent))
+	} else if err := json.Unmarshal(sent[0], &failure); err != nil {
+		t.Fatal(err)
+	}
+	if failure.AnalysisId != analysis || failure.Code != CodeMalformedMessage {
+		t.Errorf("failure = %+v, want a malformed message of analysis %s", failure, analysis)
+	}
+
+	sent := publisher.sent(deadLetterQueue)
+	if len(sent) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(sent))
+	}
+	var deadLetter DeadLetterMessage
+	if err := json.Unmarshal(sent[0], &deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetter.Queue != "dispatcher_downloader" || deadLetter.Code != CodeMalformedMessage || !strings.Contains(deadLetter.Error, `unknown field "project"`) {
+		t.Errorf("dead letter = %+v, want the unknown field as reason", deadLetter)
+	}
+}
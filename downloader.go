@@ -2,15 +2,28 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"time"
 
 	"github.com/CodeClarityCE/utility-boilerplates"
 	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/uptrace/bun"
 )
 
 // DownloaderService wraps the ServiceBase with downloader-specific functionality
 type DownloaderService struct {
 	*boilerplates.ServiceBase
+	pipeline *pipeline
+	// layout is where the workspaces removed by the sweeps live
+	layout WorkspaceLayout
+	// locker serializes the downloads and cleanups of the same workspace
+	locker WorkspaceLocker
+	// workers processes the dispatcher messages
+	workers *workerPool
+	// retrier schedules the retries of dispatcher messages failing for a transient reason
+	retrier *delayedRetrier
 }
 
 // CreateDownloaderService creates a new DownloaderService
@@ -22,17 +35,100 @@ func CreateDownloaderService() (*DownloaderService, error) {
 
 	service := &DownloaderService{
 		ServiceBase: base,
+		layout:      NewWorkspaceLayout(),
+		retrier:     newDelayedRetrier(loadRetryPolicy()),
 	}
+	db := func() *bun.DB { return base.DB.CodeClarity }
+	service.locker = newWorkspaceLocker(service.layout, db)
+	timeouts := loadStageTimeouts()
+	service.pipeline = &pipeline{
+		store:     NewBunStore(db),
+		fetchers:  defaultFetcherRegistry(service.layout, loadCloneStrategies(), service.locker, timeouts),
+		publisher: &syncPublisher{publisher: base},
+		timeouts:  timeouts,
 
-	// Setup queue handler
-	service.AddQueue("dispatcher_downloader", true, service.handleDispatcherMessage)
+		cancellations: newCancelRegistry(),
+		ledger:        NewBunLedger(db, durationEnv("DOWNLOADER_LEDGER_STALE_AFTER", defaultLedgerStaleAfter)),
+		statuses:      NewBunStatusStore(db),
+		progress:      newProgressBroadcaster(),
+	}
+
+	// Setup queue handlers, dispatcher messages are consumed by the worker pool
+	service.workers = newWorkerPool(loadWorkerPoolConfig(), service.handleDispatcherMessage)
+	service.workers.channelOpened = func(ch *amqp.Channel) { service.retrier.attach(ch) }
+	service.workers.postpone = func(d amqp.Delivery) error {
+		return service.retrier.postpone("dispatcher_downloader", d, organizationRetryDelay)
+	}
+	service.workers.recovered = service.handlePanic
 
 	return service, nil
 }
 
-// handleDispatcherMessage handles messages from dispatcher
+// handleDispatcherMessage handles messages from dispatcher.
+// It is called concurrently by the workers and acknowledges d once the result is published.
 func (s *DownloaderService) handleDispatcherMessage(d amqp.Delivery) {
-	dispatch("dispatcher_downloader", d, s.ServiceBase)
+	action := dispatch(context.Background(), "dispatcher_downloader", d, s.pipeline, s.retrier.canRetry(d))
+
+	var err error
+	switch action {
+	case actionRequeue:
+		if err = s.retrier.retry("dispatcher_downloader", d); err != nil {
+			log.Printf("Failed to schedule retry: %v", err)
+			s.requeue("dispatcher_downloader", d, s.retrier.policy.delay(deliveryAttempt(d)))
+			return
+		}
+		err = d.Ack(false)
+	case actionPostpone:
+		if err = s.retrier.postpone("dispatcher_downloader", d, inProgressRetryDelay); err != nil {
+			log.Printf("Failed to postpone message: %v", err)
+			s.requeue("dispatcher_downloader", d, inProgressRetryDelay)
+			return
+		}
+		err = d.Ack(false)
+	case actionReject:
+		log.Printf("Rejected message from dispatcher_downloader")
+		err = d.Reject(false)
+	default:
+		err = d.Ack(false)
+	}
+	if err != nil {
+		log.Printf("Failed to acknowledge message from dispatcher_downloader: %v", err)
+	}
+}
+
+// handlePanic settles d, whose handler panicked with err. Panics may come from a transient state,
+// such as a database connection being replaced, so d is retried like transient failures
+// and dead-lettered on its last attempt rather than requeued forever.
+func (s *DownloaderService) handlePanic(d amqp.Delivery, err error) {
+	if s.retrier.canRetry(d) {
+		if retryErr := s.retrier.retry("dispatcher_downloader", d); retryErr == nil {
+			if err := d.Ack(false); err != nil {
+				log.Printf("Failed to acknowledge message from dispatcher_downloader: %v", err)
+			}
+			return
+		}
+	}
+
+	err = newDownloadError(StageProcess, CodeInternalError, err)
+	if apiMessage, decodeErr := decodeDispatcherMessage(d); decodeErr == nil {
+		giveUp(s.pipeline.publisher, "dispatcher_downloader", d, apiMessage, err)
+	} else {
+		sendDeadLetter(s.pipeline.publisher, "dispatcher_downloader", d, err)
+	}
+	if err := d.Reject(false); err != nil {
+		log.Printf("Failed to reject message from dispatcher_downloader: %v", err)
+	}
+}
+
+// requeue puts the delivery back on its queue after delay, when it could not be republished through a delay queue.
+// The worker is free to process other messages in the meantime.
+func (s *DownloaderService) requeue(queue string, d amqp.Delivery, delay time.Duration) {
+	log.Printf("Requeuing message on %s in %s", queue, delay)
+	time.AfterFunc(delay, func() {
+		if err := d.Nack(false, true); err != nil {
+			log.Printf("Failed to requeue message on %s: %v", queue, err)
+		}
+	})
 }
 
 func main() {
@@ -41,6 +137,9 @@ func main() {
 
 // Downloader is a function that starts the downloader service using ServiceBase.
 func Downloader() {
+	// Scrub tokens from every log line
+	log.SetOutput(newRedactingWriter(os.Stderr, defaultRedactor))
+
 	service, err := CreateDownloaderService()
 	if err != nil {
 		log.Fatalf("Failed to create downloader service: %v", err)
@@ -51,6 +150,10 @@ func Downloader() {
 	if err := service.StartListening(); err != nil {
 		log.Fatalf("Failed to start listening: %v", err)
 	}
+	go service.pipeline.progress.run(service.ConfigSvc.AMQP.URL)
+	go subscribeCancellations(service.ConfigSvc.AMQP.URL, service.pipeline.cancellations)
+	go service.workers.consume(service.ConfigSvc.AMQP.URL, "dispatcher_downloader")
+	go sweepWorkspaces(service.layout, service.locker, service.pipeline.store, service.pipeline.timeouts.Lookup, durationEnv("DOWNLOADER_SWEEP_INTERVAL", defaultSweepInterval))
 
 	log.Printf("Downloader Service started")
 	service.WaitForever()
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/CodeClarityCE/service-project-downloader/test"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // func TestReceiveSymfony(t *testing.T) {
@@ -94,3 +99,114 @@ func TestGit(t *testing.T) {
 	// Test the dispatcher for this message
 	// dispatch(connection, d)
 }
+
+func TestHandleDispatcherMessage(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: 10 * time.Millisecond, MaxDelay: time.Second}
+	newService := func(t *testing.T, opts ...pipelineOption) *DownloaderService {
+		return &DownloaderService{
+			pipeline: newTestPipeline(t, opts...),
+			retrier:  newDelayedRetrier(policy),
+		}
+	}
+	body := dispatcherBody(uuid.New(), uuid.New())
+
+	t.Run("transient failure", func(t *testing.T) {
+		service := newService(t, withStore(unreachableStore{}))
+		channel := newRecordingChannel()
+		service.retrier.attach(channel)
+		acknowledger := newRecordingAcknowledger()
+
+		service.handleDispatcherMessage(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: body})
+		if n := len(channel.published[delayQueue("dispatcher_downloader", policy.BaseDelay)]); n != 1 {
+			t.Errorf("published %d retries, want 1", n)
+		}
+		if len(acknowledger.acks) != 1 || len(acknowledger.nacks)+len(acknowledger.rejects) != 0 {
+			t.Errorf("acks = %v, nacks = %v, rejects = %v, want the retried message acknowledged", acknowledger.acks, acknowledger.nacks, acknowledger.rejects)
+		}
+	})
+
+	t.Run("transient failure without delay queue", func(t *testing.T) {
+		service := newService(t, withStore(unreachableStore{}))
+		acknowledger := newRecordingAcknowledger()
+
+		// The handler returns at once, the message is requeued after the backoff
+		service.handleDispatcherMessage(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: body})
+		select {
+		case <-acknowledger.nacked:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message was not requeued")
+		}
+		if len(acknowledger.acks)+len(acknowledger.rejects) != 0 {
+			t.Errorf("acks = %v, rejects = %v, want the message requeued only", acknowledger.acks, acknowledger.rejects)
+		}
+	})
+
+	t.Run("download in progress", func(t *testing.T) {
+		analysis := uuid.New()
+		body := dispatcherBody(analysis, uuid.New())
+		ledger := NewMemoryLedger(time.Hour)
+		ledger.Claim(t.Context(), analysis)
+		service := newService(t, withLedger(ledger))
+		channel := newRecordingChannel()
+		service.retrier.attach(channel)
+		acknowledger := newRecordingAcknowledger()
+
+		service.handleDispatcherMessage(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: body})
+		published := channel.published[delayQueue("dispatcher_downloader", inProgressRetryDelay)]
+		if len(published) != 1 || deliveryAttempt(amqp.Delivery{Headers: published[0].Headers}) != 1 {
+			t.Errorf("published %v, want the message postponed without counting an attempt", published)
+		}
+		if len(acknowledger.acks) != 1 || len(acknowledger.nacks)+len(acknowledger.rejects) != 0 {
+			t.Errorf("acks = %v, nacks = %v, rejects = %v, want the postponed message acknowledged", acknowledger.acks, acknowledger.nacks, acknowledger.rejects)
+		}
+	})
+
+	t.Run("permanent failure", func(t *testing.T) {
+		service := newService(t)
+		acknowledger := newRecordingAcknowledger()
+
+		service.handleDispatcherMessage(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: body})
+		if len(acknowledger.rejects) != 1 || len(acknowledger.acks)+len(acknowledger.nacks) != 0 {
+			t.Errorf("acks = %v, nacks = %v, rejects = %v, want the unknown analysis rejected", acknowledger.acks, acknowledger.nacks, acknowledger.rejects)
+		}
+	})
+}
+
+func TestHandlePanic(t *testing.T) {
+	publisher := newRecordingPublisher()
+	service := &DownloaderService{
+		pipeline: newTestPipeline(t, withPublisher(publisher)),
+		retrier:  newDelayedRetrier(RetryPolicy{MaxAttempts: 2, BaseDelay: time.Second, MaxDelay: time.Second}),
+	}
+	channel := newRecordingChannel()
+	service.retrier.attach(channel)
+	body := dispatcherBody(uuid.New(), uuid.New())
+
+	// A panic may be transient, the message is retried
+	acknowledger := newRecordingAcknowledger()
+	service.handlePanic(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: body}, errors.New("handler panicked"))
+	if len(channel.published[delayQueue("dispatcher_downloader", time.Second)]) != 1 || len(acknowledger.acks) != 1 {
+		t.Errorf("acks = %v, published = %v, want the message retried", acknowledger.acks, channel.published)
+	}
+
+	// Until it runs out of attempts
+	acknowledger = newRecordingAcknowledger()
+	service.handlePanic(amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 2, Body: body, Headers: amqp.Table{attemptHeader: int32(2)}}, errors.New("handler panicked"))
+	if len(acknowledger.rejects) != 1 {
+		t.Errorf("rejects = %v, want the message rejected", acknowledger.rejects)
+	}
+	if len(publisher.sent(failureQueue)) != 1 {
+		t.Errorf("got %d failure messages, want 1", len(publisher.sent(failureQueue)))
+	}
+	sent := publisher.sent(deadLetterQueue)
+	if len(sent) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(sent))
+	}
+	var deadLetter DeadLetterMessage
+	if err := json.Unmarshal(sent[0], &deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetter.Code != CodeInternalError || deadLetter.Attempts != 2 {
+		t.Errorf("dead letter = %+v, want an internal error on attempt 2", deadLetter)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+)
+
+// failureQueue is the queue on which download failures are reported to the dispatcher.
+const failureQueue = "downloader_dispatcher_error"
+
+// DownloadStage identifies the step of the download pipeline that failed.
+type DownloadStage string
+
+const (
+	StageDecode   DownloadStage = "decode"
+	StageLookup   DownloadStage = "lookup"
+	StageClone    DownloadStage = "clone"
+	StageCheckout DownloadStage = "checkout"
+	StageExtract  DownloadStage = "extract"
+	StageDetect   DownloadStage = "detect"
+	StagePublish  DownloadStage = "publish"
+
+	// StageProcess is reported for failures that happened at no particular stage
+	StageProcess DownloadStage = "process"
+)
+
+// FailureCode is a machine-readable reason attached to a failure message.
+type FailureCode string
+
+const (
+	CodeMalformedMessage FailureCode = "malformed_message"
+	CodeNotFound         FailureCode = "not_found"
+	CodeLookupFailed     FailureCode = "lookup_failed"
+	CodeCloneFailed      FailureCode = "clone_failed"
+	CodeCheckoutFailed   FailureCode = "checkout_failed"
+	CodeExtractFailed    FailureCode = "extract_failed"
+	CodeDetectFailed     FailureCode = "detect_failed"
+
+	// CodeUnsupportedProjectType is reported when no fetcher handles the project type
+	CodeUnsupportedProjectType FailureCode = "unsupported_project_type"
+	// CodeInvalidRef is reported when the branch or commit of the analysis is not a valid ref
+	CodeInvalidRef FailureCode = "invalid_ref"
+	// CodeCommitNotFound is reported when the commit of the analysis cannot be fetched from the remote
+	CodeCommitNotFound FailureCode = "commit_not_found"
+	// CodeWorkspaceLocked is reported when another download held the workspace for too long
+	CodeWorkspaceLocked FailureCode = "workspace_locked"
+	// CodeTimedOut is reported when a stage did not complete within its timeout
+	CodeTimedOut FailureCode = "timed_out"
+	// CodeUnsupportedVersion is reported when no decoder handles the version of the message
+	CodeUnsupportedVersion FailureCode = "unsupported_version"
+	// CodeInvalidMessage is reported when the message lacks a required field
+	CodeInvalidMessage FailureCode = "invalid_message"
+	// CodePublishFailed is reported when the result of the download could not be sent to the dispatcher
+	CodePublishFailed FailureCode = "publish_failed"
+	// CodeInternalError is reported when processing the message failed unexpectedly, such as with a panic
+	CodeInternalError FailureCode = "internal_error"
+)
+
+// DownloadError is returned by the download pipeline when a stage fails.
+// It carries enough context to build a DownloaderFailureMessage.
+type DownloadError struct {
+	Stage DownloadStage
+	Code  FailureCode
+	Err   error
+}
+
+// Error implements the error interface
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("%s failed (%s): %v", e.Stage, e.Code, e.Err)
+}
+
+// Unwrap allows error unwrapping
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+// newDownloadError wraps err with the stage and code it failed with.
+func newDownloadError(stage DownloadStage, code FailureCode, err error) *DownloadError {
+	return &DownloadError{Stage: stage, Code: code, Err: err}
+}
+
+// DownloaderFailureMessage is the failure variant of DownloaderDispatcherMessage.
+// It is sent on the failureQueue so that the dispatcher can mark the analysis as failed.
+type DownloaderFailureMessage struct {
+	types_amqp.DownloaderDispatcherMessage
+	Status  string        `json:"status"`
+	Stage   DownloadStage `json:"stage"`
+	Code    FailureCode   `json:"code"`
+	Message string        `json:"message"`
+}
+
+// sendFailure reports a failed download to the dispatcher.
+// Errors that are not a DownloadError are reported as a lookup failure.
+func sendFailure(publisher Publisher, apiMessage types_amqp.DispatcherDownloaderMessage, err error, secrets ...string) {
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		downloadErr = newDownloadError(StageLookup, CodeLookupFailed, err)
+	}
+
+	failureMessage := DownloaderFailureMessage{
+		DownloaderDispatcherMessage: types_amqp.DownloaderDispatcherMessage{
+			AnalysisId:     apiMessage.AnalysisId,
+			ProjectId:      apiMessage.ProjectId,
+			IntegrationId:  apiMessage.IntegrationId,
+			OrganizationId: apiMessage.OrganizationId,
+		},
+		Status:  "failure",
+		Stage:   downloadErr.Stage,
+		Code:    downloadErr.Code,
+		Message: redact(downloadErr.Err.Error(), secrets...),
+	}
+	data, _ := json.Marshal(failureMessage)
+	if err := publisher.SendMessage(failureQueue, data); err != nil {
+		log.Printf("Failed to send message to %s: %v", failureQueue, err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+// ErrUnsupportedProjectType is returned when no SourceFetcher is registered for a project type.
+var ErrUnsupportedProjectType = errors.New("unsupported project type")
+
+// FetchRequest describes the sources to download for an analysis.
+type FetchRequest struct {
+	Analysis     codeclarity.Analysis
+	Project      codeclarity.Project
+	Integration  codeclarity.Integration
+	Organization uuid.UUID
+	// Progress is told about the progress of the download, if set
+	Progress ProgressFunc
+}
+
+// SourceType tells where the sources of a workspace come from.
+type SourceType string
+
+const (
+	// SourceGit is a clone of a git repository
+	SourceGit SourceType = "git"
+	// SourceArchive is an extracted upload
+	SourceArchive SourceType = "archive"
+)
+
+// FetchResult describes what a SourceFetcher downloaded.
+type FetchResult struct {
+	// Path is the workspace the sources were downloaded into
+	Path string
+	// Source tells how the sources were downloaded
+	Source SourceType
+	// Branch is the branch that was downloaded, resolved to the default branch if the analysis had none
+	Branch string
+	// Revision identifies the version of the sources that were fetched:
+	// the full commit SHA for git projects, the content hash of the archive for uploads
+	Revision string
+	// Commit describes the commit that was checked out, for git projects only
+	Commit *CommitInfo
+	// Metadata holds fetcher-specific information about the download
+	Metadata map[string]string
+	// Warnings tells why the workspace may not hold every file of the project
+	Warnings []string
+}
+
+// CommitInfo describes the commit a workspace was checked out at.
+type CommitInfo struct {
+	SHA         string    `json:"sha"`
+	Author      string    `json:"author"`
+	CommittedAt time.Time `json:"committed_at"`
+	Subject     string    `json:"subject"`
+}
+
+// SourceFetcher downloads the sources of a project into the workspace given by its WorkspaceLayout.
+type SourceFetcher interface {
+	// RequiresIntegration reports whether FetchRequest.Integration must be loaded before Fetch is called.
+	RequiresIntegration() bool
+	// Fetch downloads the sources described by req.
+	Fetch(ctx context.Context, req FetchRequest) (FetchResult, error)
+}
+
+// FetcherRegistry maps project types to the SourceFetcher able to download them.
+type FetcherRegistry struct {
+	fetchers map[string]SourceFetcher
+}
+
+// NewFetcherRegistry creates an empty FetcherRegistry
+func NewFetcherRegistry() *FetcherRegistry {
+	return &FetcherRegistry{fetchers: make(map[string]SourceFetcher)}
+}
+
+// defaultFetcherRegistry returns a registry with the fetchers for every supported project type,
+// all downloading into workspaces of layout locked with locker, within timeouts.
+// Git projects are cloned with strategies.
+func defaultFetcherRegistry(layout WorkspaceLayout, strategies CloneStrategies, locker WorkspaceLocker, timeouts StageTimeouts) *FetcherRegistry {
+	registry := NewFetcherRegistry()
+	git := gitFetcher{layout: layout, strategies: strategies, locker: locker, timeout: timeouts.Clone}
+	registry.Register("FILE", archiveFetcher{layout: layout, locker: locker, timeout: timeouts.Extract})
+	registry.Register("GITHUB", git)
+	registry.Register("GITLAB", git)
+	return registry
+}
+
+// Register associates a project type with the fetcher used to download it.
+// Project types are matched case-insensitively.
+func (r *FetcherRegistry) Register(projectType string, fetcher SourceFetcher) {
+	r.fetchers[strings.ToUpper(projectType)] = fetcher
+}
+
+// Get returns the fetcher registered for projectType.
+// It returns an error wrapping ErrUnsupportedProjectType if there is none.
+func (r *FetcherRegistry) Get(projectType string) (SourceFetcher, error) {
+	fetcher, ok := r.fetchers[strings.ToUpper(projectType)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedProjectType, projectType)
+	}
+	return fetcher, nil
+}
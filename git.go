@@ -1,87 +1,625 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
-	"github.com/google/uuid"
 	_ "github.com/lib/pq"
 )
 
+// WorkspaceAction tells how Git prepared the workspace of an analysis.
+type WorkspaceAction string
+
+const (
+	// WorkspaceCloned means the project was cloned into a new workspace
+	WorkspaceCloned WorkspaceAction = "cloned"
+	// WorkspaceUpdated means an existing clone of the project was fetched and reset to the requested ref
+	WorkspaceUpdated WorkspaceAction = "updated"
+	// WorkspaceRecloned means the workspace held something else and was wiped before cloning
+	WorkspaceRecloned WorkspaceAction = "recloned"
+)
+
+// GitOptions tunes how Git downloads a project.
+type GitOptions struct {
+	// Output receives the output of the git commands, it is responsible for redacting it
+	Output io.Writer
+	// Strategy decides how much of the repository is downloaded, defaulting to CloneFull
+	Strategy CloneStrategy
+	// Mirror is the bare repository shared by the workspaces of the project, required by CloneMirror
+	Mirror string
+	// Progress is told about the objects received and the files checked out, if set
+	Progress ProgressFunc
+}
+
+// GitResult describes the outcome of Git.
+type GitResult struct {
+	Action WorkspaceAction
+	// Commit is the commit HEAD resolved to once the workspace was ready
+	Commit CommitInfo
+}
+
 // Git clones a git project and checks out a specific branch or commit.
 // It takes an analysis, project, integration, and organization as input parameters.
 // The analysis parameter contains information about the branch and commit to clone.
+// Its branch must be set, analyses without one are resolved with DefaultBranch beforehand.
 // The project parameter contains the URL of the git project to clone.
 // The integration parameter contains the access token for authentication.
-// The organization parameter specifies the destination folder for the cloned project.
-// If the analysis has a commit specified, Git checks out that commit after cloning the project.
+// The token is handed to git through an ephemeral askPass helper, so it never appears
+// in the remote URL stored in the workspace.
+// The destination parameter is the workspace the project is cloned into.
+// If it already holds a clone of the same remote, the clone is fetched, hard-reset and cleaned
+// to exactly the requested ref; otherwise it is wiped and cloned again.
+// With CloneMirror, destination is instead a worktree of the mirror of the project, see gitWorktree.
+// The options parameter holds the output of the git commands, the clone strategy and the progress callback.
+// If the analysis has a commit specified, Git fetches that exact commit, wherever it lives on the remote,
+// and checks it out, deepening shallow clones as needed. A commit that cannot be obtained is reported
+// with CodeCommitNotFound.
+// Every git command is killed once ctx is done.
 // The function returns an error if any of the git commands fail.
-func Git(analysis codeclarity.Analysis, project codeclarity.Project, integration codeclarity.Integration, organization uuid.UUID) error {
-	// Clone git project
-	url := ""
-	if strings.Contains(project.Url, "gitlab") {
-		url = strings.ReplaceAll(project.Url, "://", "://oauth2:"+integration.AccessToken+"@")
-	} else {
-		url = strings.ReplaceAll(project.Url, "://", "://"+integration.AccessToken+"@")
+func Git(ctx context.Context, analysis codeclarity.Analysis, project codeclarity.Project, integration codeclarity.Integration, destination string, options GitOptions) (GitResult, error) {
+	auth, err := newAskPass(credentialsFor(project, integration))
+	if err != nil {
+		return GitResult{}, newDownloadError(StageClone, CodeCloneFailed, err)
+	}
+	defer auth.Close()
+	git := &gitSession{ctx: ctx, auth: auth, output: options.Output, strategy: options.Strategy}
+	if options.Progress != nil {
+		output := options.Output
+		if output == nil {
+			output = io.Discard
+		}
+		git.output = io.MultiWriter(output, newGitProgressWriter(options.Progress))
+		git.progress = true
+	}
+
+	if git.strategy == CloneMirror {
+		action, err := gitWorktree(git, analysis.Branch, strings.TrimSpace(analysis.Commit), project.Url, options.Mirror, destination)
+		if err != nil {
+			return GitResult{}, err
+		}
+		log.Printf("Workspace %s %s from mirror %s", destination, action, options.Mirror)
+		return git.resolve(destination, GitResult{Action: action})
+	}
+
+	result := GitResult{Action: WorkspaceCloned}
+	if _, err := os.Stat(destination); err == nil {
+		if git.isCloneOf(destination, project.Url) {
+			result.Action = WorkspaceUpdated
+		} else {
+			log.Printf("Workspace %s does not hold a clone of the project, wiping it", destination)
+			if err := os.RemoveAll(destination); err != nil {
+				return GitResult{}, newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("failed to wipe workspace: %w", err))
+			}
+			result.Action = WorkspaceRecloned
+		}
+	}
+
+	commit := strings.TrimSpace(analysis.Commit)
+	if commit != "" {
+		err = gitCommit(git, result.Action, project.Url, analysis.Branch, commit, destination)
+		if err != nil {
+			return GitResult{}, err
+		}
+		log.Printf("Workspace %s %s at commit %s", destination, result.Action, commit)
+		return git.resolve(destination, result)
+	}
+
+	if analysis.Branch == "" {
+		return GitResult{}, newDownloadError(StageClone, CodeCloneFailed, errors.New("no branch to clone"))
 	}
 
-	// GET download path from ENV
-	path := os.Getenv("DOWNLOAD_PATH")
+	if result.Action == WorkspaceUpdated {
+		err = git.update(destination, project.Url, analysis.Branch)
+		if err != nil && !errors.Is(err, errFetchFailed) {
+			// The clone is unusable, start over from scratch
+			log.Printf("Failed to update workspace %s, wiping it: %v", destination, err)
+			if err := os.RemoveAll(destination); err != nil {
+				return GitResult{}, newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("failed to wipe workspace: %w", err))
+			}
+			result.Action = WorkspaceRecloned
+		} else if err != nil {
+			return GitResult{}, newDownloadError(StageClone, CodeCloneFailed, err)
+		}
+	}
+
+	if result.Action != WorkspaceUpdated {
+		// Clone project
+		args := []string{"clone"}
+		switch git.strategy {
+		case CloneManifests:
+			// The sparse checkout must be set up before any file is checked out
+			args = append(args, "--no-checkout")
+		case CloneShallow:
+			args = append(args, "--recursive", "--shallow-submodules")
+		default:
+			args = append(args, "--recursive")
+		}
+		args = append(args, git.strategy.fetchArgs()...)
+		err = git.run("", append(args, "-b", analysis.Branch, project.Url, destination)...)
+		if err == nil && git.strategy == CloneManifests {
+			err = git.sparseCheckout(destination)
+			if err == nil {
+				err = git.run(destination, "checkout", "--force", analysis.Branch)
+			}
+		}
+		if err != nil {
+			return GitResult{}, newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("git clone failed: %w", err))
+		}
+	}
+	log.Printf("Workspace %s %s", destination, result.Action)
+	return git.resolve(destination, result)
+}
+
+// DefaultBranch returns the default branch of the remote of project,
+// the branch its HEAD points to, using the access token of integration.
+func DefaultBranch(ctx context.Context, project codeclarity.Project, integration codeclarity.Integration, output io.Writer) (string, error) {
+	auth, err := newAskPass(credentialsFor(project, integration))
+	if err != nil {
+		return "", err
+	}
+	defer auth.Close()
+	git := &gitSession{ctx: ctx, auth: auth, output: output}
 
-	// Destination folder
-	destination := fmt.Sprintf("%s/%s/%s/%s", path, organization, "projects", project.Id)
+	out, err := git.read("", "ls-remote", "--symref", project.Url, "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("git ls-remote failed: %w", err)
+	}
+	return parseSymref(out)
+}
 
-	if analysis.Commit == "" || analysis.Commit == " " {
-		destination = fmt.Sprintf("%s/%s", destination, analysis.Branch)
+// parseSymref extracts the branch from the output of `git ls-remote --symref <url> HEAD`,
+// whose first line reads "ref: refs/heads/<branch>\tHEAD".
+func parseSymref(out string) (string, error) {
+	for _, line := range strings.Split(out, "\n") {
+		target, ok := strings.CutPrefix(line, "ref: ")
+		if !ok {
+			continue
+		}
+		ref, _, _ := strings.Cut(target, "\t")
+		if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok && branch != "" {
+			return branch, nil
+		}
+	}
+	return "", fmt.Errorf("remote HEAD does not point to a branch")
+}
+
+// gitCommit prepares destination as a clone of url with exactly commit checked out.
+// Unlike a clone of branch, it also works for commits only reachable from other branches,
+// pull or merge requests, or from a branch deleted since the analysis was scheduled.
+func gitCommit(git *gitSession, action WorkspaceAction, url string, branch string, commit string, destination string) error {
+	if action == WorkspaceUpdated {
+		// Drop any credentials stored in the remote URL by older versions of the downloader
+		if err := git.run(destination, "remote", "set-url", "origin", url); err != nil {
+			return newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("git remote set-url failed: %w", err))
+		}
 	} else {
-		destination = fmt.Sprintf("%s/%s", destination, analysis.Commit)
+		if err := git.run("", "init", "--quiet", destination); err != nil {
+			return newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("git init failed: %w", err))
+		}
+		if err := git.run(destination, "remote", "add", "origin", url); err != nil {
+			return newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("git remote add failed: %w", err))
+		}
+	}
+
+	err := git.fetchCommit(destination, branch, commit)
+	if errors.Is(err, ErrCommitNotFound) {
+		return newDownloadError(StageCheckout, CodeCommitNotFound, err)
+	} else if err != nil {
+		return newDownloadError(StageClone, CodeCloneFailed, err)
 	}
 
-	// Clone project
-	cmd := exec.Command("git", "clone", "--recursive", "-b", analysis.Branch, url, destination)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	if err := git.sparseCheckout(destination); err != nil {
+		return newDownloadError(StageCheckout, CodeCheckoutFailed, err)
+	}
+	for _, args := range [][]string{
+		{"checkout", "--force", "--detach", commit},
+		{"clean", "-ffdx"},
+	} {
+		if err := git.run(destination, args...); err != nil {
+			return newDownloadError(StageCheckout, CodeCheckoutFailed, fmt.Errorf("git %s failed: %w", args[0], err))
+		}
+	}
+	if err := git.updateSubmodules(destination); err != nil {
+		return newDownloadError(StageCheckout, CodeCheckoutFailed, err)
+	}
+
+	// Make sure we analyze exactly what was asked for
+	head, err := git.read(destination, "rev-parse", "HEAD")
 	if err != nil {
-		log.Println(err.Error())
-		// updateDownloadStatus(name, project, "f")
-		cmd := exec.Command("git", "pull")
-		cmd.Dir = destination
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		if err != nil {
-			log.Println(err.Error())
-			return err
+		return newDownloadError(StageCheckout, CodeCheckoutFailed, fmt.Errorf("git rev-parse failed: %w", err))
+	}
+	if !strings.HasPrefix(head, strings.ToLower(commit)) {
+		return newDownloadError(StageCheckout, CodeCommitNotFound, fmt.Errorf("%w: HEAD is %s instead of %s", ErrCommitNotFound, head, commit))
+	}
+	return nil
+}
+
+var (
+	// errFetchFailed is returned by gitSession.update when the remote could not be fetched.
+	errFetchFailed = errors.New("git fetch failed")
+	// ErrCommitNotFound is returned when the requested commit does not exist on the remote.
+	ErrCommitNotFound = errors.New("commit not found")
+)
+
+// commitRefspecs are fetched, in order, to find a commit that cannot be fetched directly.
+// They cover the heads of GitHub pull requests, GitLab merge requests and every branch.
+var commitRefspecs = []string{
+	"+refs/pull/*/head:refs/remotes/origin/pull/*",
+	"+refs/merge-requests/*/head:refs/remotes/origin/merge-requests/*",
+	"+refs/heads/*:refs/remotes/origin/*",
+}
+
+// gitWaitDelay bounds the time spent waiting for the output of a killed git command.
+const gitWaitDelay = 5 * time.Second
+
+// gitSession runs the git commands of a single download with the same context, credentials, output and strategy.
+type gitSession struct {
+	// ctx kills the running git command once it is done, a nil ctx never does
+	ctx      context.Context
+	auth     *askPass
+	output   io.Writer
+	strategy CloneStrategy
+	// progress makes the commands that download or check out files report their progress
+	progress bool
+}
+
+// command returns a git command running in dir, authenticating through auth and writing to output.
+// Credential helpers are disabled so that git never stores the credentials it is given.
+// The command runs in its own process group, which is killed with it when ctx is done,
+// so that the helpers git spawns for the transport do not outlive it.
+func (s *gitSession) command(dir string, args ...string) *exec.Cmd {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if s.progress && len(args) > 0 {
+		switch args[0] {
+		case "clone", "fetch", "checkout":
+			args = append([]string{args[0], "--progress"}, args[1:]...)
 		}
 	}
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "credential.helper="}, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = gitWaitDelay
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), s.auth.Env()...)
+	cmd.Stdout = s.output
+	cmd.Stderr = s.output
+	if s.output == nil {
+		cmd.Stdout = io.Discard
+		cmd.Stderr = io.Discard
+	}
+	return cmd
+}
 
-	if analysis.Commit == "" || analysis.Commit == " " {
-		return nil
+// fetch fetches refspecs from origin into the repository in dir, as limited by the clone strategy.
+func (s *gitSession) fetch(dir string, refspecs ...string) error {
+	args := append([]string{"fetch", "--prune"}, s.strategy.fetchArgs()...)
+	return s.run(dir, append(append(args, "origin"), refspecs...)...)
+}
+
+// run runs git with args in dir.
+func (s *gitSession) run(dir string, args ...string) error {
+	return runGit(s.command(dir, args...))
+}
+
+// read runs git with args in dir and returns its trimmed standard output.
+func (s *gitSession) read(dir string, args ...string) (string, error) {
+	cmd := s.command(dir, args...)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := runGit(cmd)
+	return strings.TrimSpace(stdout.String()), err
+}
+
+// ErrTransientRemote is returned when git could not reach the remote or the remote failed to answer.
+// The download may succeed if retried later.
+var ErrTransientRemote = errors.New("transient remote error")
+
+// transientGitErrors are the messages git prints when the transport failed rather than the request,
+// e.g. for network blips and 5xx or 429 responses of the git host. They are matched in lower case.
+var transientGitErrors = []string{
+	"could not resolve host",
+	"temporary failure in name resolution",
+	"connection timed out",
+	"operation timed out",
+	"connection refused",
+	"connection reset",
+	"early eof",
+	"unexpected disconnect",
+	"rpc failed",
+	"the requested url returned error: 5",
+	"the requested url returned error: 429",
+	"tls connection was non-properly terminated",
+	"gnutls_handshake() failed",
+}
+
+// runGit runs cmd and adds the last line git printed to the error it fails with.
+// Failures of the transport are reported with ErrTransientRemote.
+func runGit(cmd *exec.Cmd) error {
+	stderr := &tailWriter{}
+	output := io.MultiWriter(cmd.Stderr, stderr)
+	if cmd.Stdout == cmd.Stderr {
+		// Keep a single pipe, the output is not safe for concurrent writes
+		cmd.Stdout = output
+	}
+	cmd.Stderr = output
+
+	if err := cmd.Run(); err != nil {
+		return classifyGitError(err, stderr.lastLine())
+	}
+	return nil
+}
+
+// classifyGitError wraps err, returned by a git command whose output ended with message,
+// with ErrTransientRemote when message matches one of the transientGitErrors.
+func classifyGitError(err error, message string) error {
+	if message == "" {
+		return err
+	}
+	lower := strings.ToLower(message)
+	for _, transient := range transientGitErrors {
+		if strings.Contains(lower, transient) {
+			return fmt.Errorf("%w: %w: %s", ErrTransientRemote, err, message)
+		}
 	}
+	return fmt.Errorf("%w: %s", err, message)
+}
+
+// tailWriter keeps the end of what is written to it.
+type tailWriter struct {
+	tail []byte
+}
+
+// tailWriterSize is how much of the output of a command a tailWriter keeps.
+const tailWriterSize = 4096
 
-	// Check branches
-	cmd = exec.Command("git", "checkout", analysis.Commit)
-	cmd.Dir = destination
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+// Write implements io.Writer
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.tail = append(w.tail, p...)
+	if len(w.tail) > tailWriterSize {
+		w.tail = w.tail[len(w.tail)-tailWriterSize:]
+	}
+	return len(p), nil
+}
+
+// lastLine returns the last non-empty line written, progress updates ending with a carriage return included.
+func (w *tailWriter) lastLine() string {
+	lines := strings.FieldsFunc(string(w.tail), func(r rune) bool { return r == '\n' || r == '\r' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+// isCloneOf reports whether dir is the top level of a git repository whose origin is url.
+// Worktrees of a mirror are not clones, as they share the repository of the mirror.
+func (s *gitSession) isCloneOf(dir string, url string) bool {
+	topLevel, err := s.read(dir, "rev-parse", "--show-toplevel")
+	if err != nil || !samePath(topLevel, dir) || s.isLinkedWorktree(dir) {
+		return false
+	}
+	origin, err := s.read(dir, "config", "--get", "remote.origin.url")
 	if err != nil {
-		log.Println(err.Error())
-		// updateDownloadStatus(name, project, "f")
+		return false
+	}
+	return normalizeRemoteURL(origin) == normalizeRemoteURL(url)
+}
+
+// update fetches branch from origin and resets the clone in dir to exactly its tip,
+// removing any local change and untracked file.
+// It returns an error wrapping errFetchFailed if the remote could not be fetched.
+func (s *gitSession) update(dir string, url string, branch string) error {
+	// Drop any credentials stored in the remote URL by older versions of the downloader
+	if err := s.run(dir, "remote", "set-url", "origin", url); err != nil {
+		return fmt.Errorf("git remote set-url failed: %w", err)
+	}
+
+	remoteBranch := "refs/remotes/origin/" + branch
+	if err := s.fetch(dir, "+refs/heads/"+branch+":"+remoteBranch); err != nil {
+		return fmt.Errorf("%w: %w", errFetchFailed, err)
+	}
+
+	if err := s.sparseCheckout(dir); err != nil {
 		return err
 	}
+	for _, args := range [][]string{
+		{"checkout", "--force", "-B", branch, remoteBranch},
+		{"reset", "--hard", remoteBranch},
+		{"clean", "-ffdx"},
+	} {
+		if err := s.run(dir, args...); err != nil {
+			return fmt.Errorf("git %s failed: %w", args[0], err)
+		}
+	}
+	return s.updateSubmodules(dir)
+}
+
+// sparseCheckout restricts the files checked out in dir to the sparse patterns of the strategy.
+// A workspace that was sparse but whose strategy is not anymore gets all its files back.
+func (s *gitSession) sparseCheckout(dir string) error {
+	patterns := s.strategy.sparsePatterns()
+	if patterns == nil {
+		if sparse, _ := s.read(dir, "config", "--bool", "core.sparseCheckout"); sparse != "true" {
+			return nil
+		}
+		if err := s.run(dir, "sparse-checkout", "disable"); err != nil {
+			return fmt.Errorf("git sparse-checkout disable failed: %w", err)
+		}
+		return nil
+	}
+	if err := s.run(dir, append([]string{"sparse-checkout", "set", "--no-cone"}, patterns...)...); err != nil {
+		return fmt.Errorf("git sparse-checkout set failed: %w", err)
+	}
+	return nil
+}
 
-	// Update download status
-	// updateDownloadStatus(name, project, "t")
+// updateSubmodules checks out the submodules of the repository in dir.
+// Sparse workspaces skip them, as the manifests of submodules are not analyzed.
+func (s *gitSession) updateSubmodules(dir string) error {
+	if s.strategy.sparsePatterns() != nil {
+		return nil
+	}
+	if err := s.run(dir, "submodule", "update", "--init", "--recursive", "--force"); err != nil {
+		return fmt.Errorf("git submodule failed: %w", err)
+	}
 	return nil
 }
 
+// fetchCommit fetches commit from origin into the repository in dir.
+// It asks for the object directly, which only works for full hashes, then falls back to
+// branch and to the refs in commitRefspecs. Shallow histories are then deepened until the commit is found.
+// It returns an error wrapping ErrCommitNotFound if commit is still missing once everything was fetched,
+// or errFetchFailed if the remote could not be fetched.
+func (s *gitSession) fetchCommit(dir string, branch string, commit string) error {
+	if s.fetch(dir, commit) == nil && s.hasCommit(dir, commit) {
+		return nil
+	}
+
+	refspecs := commitRefspecs
+	if branch != "" {
+		refspecs = append([]string{"+refs/heads/" + branch + ":refs/remotes/origin/" + branch}, refspecs...)
+	}
+	fetched := false
+	for _, refspec := range refspecs {
+		if err := s.fetch(dir, refspec); err != nil {
+			log.Printf("Failed to fetch %s: %v", refspec, err)
+			continue
+		}
+		fetched = true
+		if s.hasCommit(dir, commit) {
+			return nil
+		}
+	}
+
+	if !fetched {
+		return fmt.Errorf("%w: could not fetch origin", errFetchFailed)
+	}
+	if s.deepen(dir, commit) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrCommitNotFound, commit)
+}
+
+// deepenSteps are the number of commits a shallow history is successively deepened by
+// before fetching it entirely.
+var deepenSteps = []int{50, 500}
+
+// deepen extends the history of a shallow repository in dir until it holds commit.
+// It reports whether commit was found.
+func (s *gitSession) deepen(dir string, commit string) bool {
+	for _, depth := range deepenSteps {
+		if !s.isShallow(dir) {
+			return false
+		}
+		log.Printf("Commit %s not found in shallow history, deepening by %d", commit, depth)
+		if err := s.run(dir, "fetch", "--deepen", strconv.Itoa(depth), "origin"); err != nil {
+			log.Printf("Failed to deepen history: %v", err)
+			return false
+		}
+		if s.hasCommit(dir, commit) {
+			return true
+		}
+	}
+
+	if !s.isShallow(dir) {
+		return false
+	}
+	log.Printf("Commit %s not found in shallow history, fetching the entire history", commit)
+	if err := s.run(dir, "fetch", "--unshallow", "origin"); err != nil {
+		log.Printf("Failed to unshallow history: %v", err)
+		return false
+	}
+	return s.hasCommit(dir, commit)
+}
+
+// isShallow reports whether the repository in dir has a truncated history.
+func (s *gitSession) isShallow(dir string) bool {
+	out, err := s.read(dir, "rev-parse", "--is-shallow-repository")
+	return err == nil && out == "true"
+}
+
+// resolve fills result with the commit HEAD points to in dir.
+func (s *gitSession) resolve(dir string, result GitResult) (GitResult, error) {
+	commit, err := s.head(dir)
+	if err != nil {
+		return GitResult{}, newDownloadError(StageCheckout, CodeCheckoutFailed, fmt.Errorf("failed to resolve HEAD: %w", err))
+	}
+	result.Commit = commit
+	return result, nil
+}
+
+// head returns the commit HEAD points to in dir.
+func (s *gitSession) head(dir string) (CommitInfo, error) {
+	out, err := s.read(dir, "log", "-1", "--format=%H%x00%an <%ae>%x00%cI%x00%s", "HEAD")
+	if err != nil {
+		return CommitInfo{}, err
+	}
+	fields := strings.SplitN(out, "\x00", 4)
+	if len(fields) != 4 {
+		return CommitInfo{}, fmt.Errorf("unexpected git log output %q", out)
+	}
+	committedAt, err := time.Parse(time.RFC3339, fields[2])
+	if err != nil {
+		return CommitInfo{}, fmt.Errorf("invalid committer date: %w", err)
+	}
+	return CommitInfo{SHA: fields[0], Author: fields[1], CommittedAt: committedAt, Subject: fields[3]}, nil
+}
+
+// hasCommit reports whether the repository in dir holds commit.
+func (s *gitSession) hasCommit(dir string, commit string) bool {
+	_, err := s.read(dir, "rev-parse", "--quiet", "--verify", commit+"^{commit}")
+	return err == nil
+}
+
+// normalizeRemoteURL returns url without credentials, trailing slash or ".git" suffix,
+// so that URLs pointing to the same repository compare equal.
+func normalizeRemoteURL(url string) string {
+	url = urlUserinfo.ReplaceAllString(strings.TrimSpace(url), "://")
+	url = strings.TrimSuffix(url, "/")
+	return strings.TrimSuffix(url, ".git")
+}
+
+// samePath reports whether a and b point to the same directory.
+func samePath(a string, b string) bool {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(infoA, infoB)
+}
+
+// ecosystemManifests lists the dependency manifests and lockfiles of the languages the detector knows about.
+// They are also the only files checked out by the CloneManifests strategy.
+var ecosystemManifests = []struct {
+	language string
+	files    []string
+}{
+	{"javascript", []string{"package.json", "package-lock.json", "yarn.lock", "pnpm-lock.yaml"}},
+	{"php", []string{"composer.json", "composer.lock"}},
+}
+
 // LanguageDetectionResult represents the result of language detection
 type LanguageDetectionResult struct {
 	DetectedLanguages   []string `json:"detected_languages"`
@@ -94,18 +632,14 @@ type LanguageDetectionResult struct {
 func detectLanguagesFromRepository(projectPath string) LanguageDetectionResult {
 	detectedLanguages := []string{}
 
-	// Check for JavaScript/Node.js
-	if fileExists(filepath.Join(projectPath, "package.json")) ||
-		fileExists(filepath.Join(projectPath, "package-lock.json")) ||
-		fileExists(filepath.Join(projectPath, "yarn.lock")) ||
-		fileExists(filepath.Join(projectPath, "pnpm-lock.yaml")) {
-		detectedLanguages = append(detectedLanguages, "javascript")
-	}
-
-	// Check for PHP
-	if fileExists(filepath.Join(projectPath, "composer.json")) ||
-		fileExists(filepath.Join(projectPath, "composer.lock")) {
-		detectedLanguages = append(detectedLanguages, "php")
+	// Check for the manifests of each ecosystem
+	for _, ecosystem := range ecosystemManifests {
+		for _, file := range ecosystem.files {
+			if fileExists(filepath.Join(projectPath, file)) {
+				detectedLanguages = append(detectedLanguages, ecosystem.language)
+				break
+			}
+		}
 	}
 
 	// Determine primary language based on priority and manifest files
@@ -174,3 +708,100 @@ func contains(slice []string, item string) bool {
 	}
 	return false
 }
+
+// gitFetcher is the SourceFetcher for projects hosted on a git forge (GITHUB, GITLAB).
+type gitFetcher struct {
+	layout     WorkspaceLayout
+	strategies CloneStrategies
+	locker     WorkspaceLocker
+	// timeout bounds the discovery of the default branch and the download, it is not bounded if zero
+	timeout time.Duration
+}
+
+// RequiresIntegration implements SourceFetcher, the integration holds the access token.
+func (gitFetcher) RequiresIntegration() bool {
+	return true
+}
+
+// Fetch implements SourceFetcher by cloning the project with Git.
+// Analyses without a branch use the default branch of the remote.
+func (f gitFetcher) Fetch(ctx context.Context, req FetchRequest) (FetchResult, error) {
+	// Keep the redacted git output of the analysis for diagnostics
+	diagnostics, err := f.layout.OpenDiagnostics(req.Organization, req.Analysis.Id)
+	if err != nil {
+		return FetchResult{}, newDownloadError(StageClone, CodeCloneFailed, err)
+	}
+	defer diagnostics.Close()
+	output := newRedactingWriter(io.MultiWriter(os.Stdout, diagnostics), defaultRedactor)
+	defer output.Close()
+
+	req.Progress.report(PhaseCloning, Progress{})
+	if req.Analysis.Branch == "" {
+		branchCtx, cancel := withStageTimeout(ctx, f.timeout)
+		req.Analysis.Branch, err = DefaultBranch(branchCtx, req.Project, req.Integration, output)
+		if err != nil {
+			err = timedOut(branchCtx, StageClone, newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("failed to discover the default branch: %w", err)))
+			cancel()
+			return FetchResult{}, err
+		}
+		cancel()
+		log.Printf("Using default branch %s of project %s", req.Analysis.Branch, req.Project.Id)
+	}
+
+	ref, destination, err := f.layout.Workspace(req)
+	if err != nil {
+		return FetchResult{}, err
+	}
+
+	strategy := f.strategies.Resolve(req.Analysis, req.Project, req.Organization)
+	mirror := f.layout.MirrorPath(req.Organization, req.Project.Id)
+	locked := []string{destination}
+	if strategy == CloneMirror {
+		// Every worktree is written through the mirror
+		locked = []string{mirror, destination}
+	}
+	unlock, err := lockWorkspaces(ctx, f.locker, StageClone, locked...)
+	if err != nil {
+		return FetchResult{}, err
+	}
+	defer unlock()
+
+	cloneCtx, cancel := withStageTimeout(ctx, f.timeout)
+	defer cancel()
+	gitResult, err := Git(cloneCtx, req.Analysis, req.Project, req.Integration, destination, GitOptions{
+		Output:   output,
+		Strategy: strategy,
+		Mirror:   mirror,
+		Progress: req.Progress,
+	})
+	if err != nil {
+		if isCanceled(ctx) {
+			discardCanceledWorkspace(f.layout, req, ref, destination)
+		}
+		return FetchResult{}, timedOut(cloneCtx, StageClone, err)
+	}
+	if err := f.layout.AddReference(req.Organization, req.Project.Id, ref, req.Analysis.Id); err != nil {
+		// The workspace is usable, it will only be kept when the analysis is deleted
+		log.Printf("Failed to record the reference of analysis %s to %s: %v", req.Analysis.Id, destination, err)
+	}
+
+	var warnings []string
+	if strategy == CloneManifests {
+		warnings = append(warnings, "sparse checkout: only the dependency manifests and lockfiles were checked out")
+	}
+	return FetchResult{
+		Path:     destination,
+		Source:   SourceGit,
+		Branch:   req.Analysis.Branch,
+		Revision: gitResult.Commit.SHA,
+		Commit:   &gitResult.Commit,
+		Metadata: map[string]string{
+			"url":              req.Project.Url,
+			"branch":           req.Analysis.Branch,
+			"ref":              ref,
+			"workspace_action": string(gitResult.Action),
+			"clone_strategy":   string(strategy),
+		},
+		Warnings: warnings,
+	}, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// defaultLedgerStaleAfter is how long a download may go without progress before another one takes it over,
+// when DOWNLOADER_LEDGER_STALE_AFTER is not set. It exceeds the default clone timeout and lock wait.
+const defaultLedgerStaleAfter = time.Hour
+
+// inProgressRetryDelay is how long a message whose analysis is being downloaded elsewhere waits
+// before it is processed again, until that download is published, failed or stale.
+const inProgressRetryDelay = 30 * time.Second
+
+// LedgerState is the state of the download of an analysis.
+type LedgerState string
+
+const (
+	// LedgerReceived means the message of the analysis was claimed by a downloader
+	LedgerReceived LedgerState = "received"
+	// LedgerFetching means the project of the analysis is being downloaded
+	LedgerFetching LedgerState = "fetching"
+	// LedgerFetched means the project was downloaded, its result is being published
+	LedgerFetched LedgerState = "fetched"
+	// LedgerPublished means the result was published to the dispatcher, the analysis is never downloaded again
+	LedgerPublished LedgerState = "published"
+	// LedgerFailed means the download failed or was canceled, the analysis may be downloaded again
+	LedgerFailed LedgerState = "failed"
+)
+
+// LedgerEntry records the download of an analysis, so that redelivered messages are not processed twice.
+type LedgerEntry struct {
+	bun.BaseModel `bun:"table:download_ledger,alias:l"`
+
+	AnalysisId uuid.UUID   `bun:"analysis_id,pk,type:uuid"`
+	State      LedgerState `bun:"state,notnull"`
+	// Owner identifies the downloader that claimed the analysis
+	Owner string `bun:"owner,notnull"`
+	// Attempts counts the claims of the analysis
+	Attempts int `bun:"attempts,notnull"`
+	// Result is the message published to the dispatcher once the project is fetched
+	Result string `bun:"result,nullzero"`
+	// Error is the last error the download failed with
+	Error     string    `bun:"error,nullzero"`
+	UpdatedAt time.Time `bun:"updated_at,notnull"`
+}
+
+// claimable reports whether the download of entry may be taken over at now:
+// it failed, or it is in progress without having been updated for staleAfter.
+func (e LedgerEntry) claimable(now time.Time, staleAfter time.Duration) bool {
+	switch e.State {
+	case LedgerFailed:
+		return true
+	case LedgerPublished:
+		return false
+	default:
+		return now.Sub(e.UpdatedAt) > staleAfter
+	}
+}
+
+// Ledger records the state of the download of each analysis.
+type Ledger interface {
+	// Claim records that this downloader processes the analysis, unless its download completed
+	// or is in progress elsewhere. It reports whether the analysis was claimed, and the entry found otherwise.
+	Claim(ctx context.Context, analysisID uuid.UUID) (LedgerEntry, bool, error)
+	// Record updates the state of a download claimed by this downloader, along with its result or error if not empty.
+	Record(ctx context.Context, analysisID uuid.UUID, state LedgerState, result string, message string) error
+}
+
+// ledgerOwner identifies this downloader in the ledger.
+func ledgerOwner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", hostname, os.Getpid(), uuid.NewString()[:8])
+}
+
+// BunLedger implements Ledger on top of the download_ledger table,
+// which is created by a migration of the API, see migrations/0003_download_ledger.sql.
+type BunLedger struct {
+	// db returns the current connection, which ServiceBase replaces when it reconnects
+	db         func() *bun.DB
+	owner      string
+	staleAfter time.Duration
+}
+
+// NewBunLedger creates a BunLedger taking over downloads that made no progress for staleAfter.
+func NewBunLedger(db func() *bun.DB, staleAfter time.Duration) *BunLedger {
+	return &BunLedger{db: db, owner: ledgerOwner(), staleAfter: staleAfter}
+}
+
+// Claim implements Ledger, a single downloader claims an analysis even if several do at once.
+func (l *BunLedger) Claim(ctx context.Context, analysisID uuid.UUID) (LedgerEntry, bool, error) {
+	now := time.Now()
+	entry := LedgerEntry{AnalysisId: analysisID, State: LedgerReceived, Owner: l.owner, Attempts: 1, UpdatedAt: now}
+	res, err := l.db().NewInsert().
+		Model(&entry).
+		On("CONFLICT (analysis_id) DO UPDATE").
+		Set("state = EXCLUDED.state").
+		Set("owner = EXCLUDED.owner").
+		Set("attempts = l.attempts + 1").
+		Set("result = NULL").
+		Set("error = NULL").
+		Set("updated_at = EXCLUDED.updated_at").
+		Where("l.state = ? OR (l.state <> ? AND l.updated_at < ?)", LedgerFailed, LedgerPublished, now.Add(-l.staleAfter)).
+		Returning("NULL").
+		Exec(ctx)
+	if err != nil {
+		return LedgerEntry{}, false, classifyDBError("ledger entry", analysisID, err)
+	}
+	if rows, err := res.RowsAffected(); err == nil && rows > 0 {
+		return entry, true, nil
+	}
+
+	var existing LedgerEntry
+	if err := l.db().NewSelect().Model(&existing).Where("analysis_id = ?", analysisID).Scan(ctx); err != nil {
+		return LedgerEntry{}, false, classifyDBError("ledger entry", analysisID, err)
+	}
+	return existing, false, nil
+}
+
+// Record implements Ledger, downloads taken over by another downloader are left to it.
+func (l *BunLedger) Record(ctx context.Context, analysisID uuid.UUID, state LedgerState, result string, message string) error {
+	query := l.db().NewUpdate().
+		Model((*LedgerEntry)(nil)).
+		Set("state = ?", state).
+		Set("updated_at = ?", time.Now()).
+		Where("analysis_id = ?", analysisID).
+		Where("owner = ?", l.owner)
+	if result != "" {
+		query = query.Set("result = ?", result)
+	}
+	if message != "" {
+		query = query.Set("error = ?", message)
+	}
+	if _, err := query.Exec(ctx); err != nil {
+		return classifyDBError("ledger entry", analysisID, err)
+	}
+	return nil
+}
+
+// MemoryLedger is an in-memory Ledger, used to run the pipeline without a database.
+type MemoryLedger struct {
+	mu         sync.Mutex
+	owner      string
+	staleAfter time.Duration
+	entries    map[uuid.UUID]LedgerEntry
+}
+
+// NewMemoryLedger creates an empty MemoryLedger taking over downloads that made no progress for staleAfter.
+func NewMemoryLedger(staleAfter time.Duration) *MemoryLedger {
+	return &MemoryLedger{owner: ledgerOwner(), staleAfter: staleAfter, entries: make(map[uuid.UUID]LedgerEntry)}
+}
+
+// Claim implements Ledger
+func (l *MemoryLedger) Claim(ctx context.Context, analysisID uuid.UUID) (LedgerEntry, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	entry, ok := l.entries[analysisID]
+	if ok && !entry.claimable(now, l.staleAfter) {
+		return entry, false, nil
+	}
+	entry = LedgerEntry{AnalysisId: analysisID, State: LedgerReceived, Owner: l.owner, Attempts: entry.Attempts + 1, UpdatedAt: now}
+	l.entries[analysisID] = entry
+	return entry, true, nil
+}
+
+// Record implements Ledger
+func (l *MemoryLedger) Record(ctx context.Context, analysisID uuid.UUID, state LedgerState, result string, message string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[analysisID]
+	if !ok || entry.Owner != l.owner {
+		return nil
+	}
+	entry.State = state
+	entry.UpdatedAt = time.Now()
+	if result != "" {
+		entry.Result = result
+	}
+	if message != "" {
+		entry.Error = message
+	}
+	l.entries[analysisID] = entry
+	return nil
+}
+
+// claimDownload claims the download of analysis in the ledger of p, if any.
+// It reports false when the download must not be started: it is in progress elsewhere,
+// or the project was fetched already, in which case its stored result is returned to be published again.
+// The download is claimed when the ledger cannot be reached, downloading twice being better than never.
+func claimDownload(ctx context.Context, p *pipeline, analysis uuid.UUID) (bool, string) {
+	if p.ledger == nil {
+		return true, ""
+	}
+	ledgerCtx, cancel := withStageTimeout(ctx, p.timeouts.Lookup)
+	defer cancel()
+	entry, claimed, err := p.ledger.Claim(ledgerCtx, analysis)
+	if err != nil {
+		log.Printf("Failed to claim analysis %s in the ledger: %v", analysis, err)
+		return true, ""
+	}
+	if claimed {
+		return true, ""
+	}
+
+	// Fetched results were not published, or may not have been
+	if (entry.State == LedgerPublished || entry.State == LedgerFetched) && entry.Result != "" {
+		log.Printf("Analysis %s was already downloaded, publishing its result again", analysis)
+		return false, entry.Result
+	}
+	log.Printf("Analysis %s is already being downloaded by %s, postponing", analysis, entry.Owner)
+	return false, ""
+}
+
+// recordDownload records the state of the download of analysis in the ledger of p, if any.
+// It is recorded even if ctx was canceled.
+func recordDownload(ctx context.Context, p *pipeline, analysis uuid.UUID, state LedgerState, result string, message string) {
+	if p.ledger == nil {
+		return
+	}
+	ledgerCtx, cancel := withStageTimeout(context.WithoutCancel(ctx), p.timeouts.Lookup)
+	defer cancel()
+	if err := p.ledger.Record(ledgerCtx, analysis, state, result, message); err != nil {
+		log.Printf("Failed to record analysis %s as %s in the ledger: %v", analysis, state, err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestMemoryLedgerClaim(t *testing.T) {
+	ctx := context.Background()
+	ledger := NewMemoryLedger(time.Hour)
+	analysis := uuid.New()
+
+	if _, claimed, _ := ledger.Claim(ctx, analysis); !claimed {
+		t.Fatal("Claim() refused a new analysis")
+	}
+	if entry, claimed, _ := ledger.Claim(ctx, analysis); claimed || entry.State != LedgerReceived {
+		t.Errorf("Claim() = %s, %v, want the download in progress", entry.State, claimed)
+	}
+
+	ledger.Record(ctx, analysis, LedgerFailed, "", "clone failed")
+	entry, claimed, _ := ledger.Claim(ctx, analysis)
+	if !claimed || entry.Attempts != 2 {
+		t.Errorf("Claim() = %+v, %v, want a second attempt after a failure", entry, claimed)
+	}
+
+	// A download that stopped making progress is taken over
+	entry = ledger.entries[analysis]
+	entry.UpdatedAt = time.Now().Add(-2 * time.Hour)
+	ledger.entries[analysis] = entry
+	if _, claimed, _ := ledger.Claim(ctx, analysis); !claimed {
+		t.Error("Claim() refused a stale download")
+	}
+
+	ledger.Record(ctx, analysis, LedgerPublished, `{"analysis_id":"x"}`, "")
+	entry = ledger.entries[analysis]
+	entry.UpdatedAt = time.Now().Add(-2 * time.Hour)
+	ledger.entries[analysis] = entry
+	if entry, claimed, _ := ledger.Claim(ctx, analysis); claimed || entry.Result != `{"analysis_id":"x"}` {
+		t.Errorf("Claim() = %+v, %v, want the published result", entry, claimed)
+	}
+}
+
+func TestDispatchRedeliveredMessage(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+
+	store := NewMemoryStore()
+	message := newFileProjectFixture(t, store, root, "", "", map[string]string{"package.json": `{}`})
+	body, _ := json.Marshal(message)
+	ledger := NewMemoryLedger(time.Hour)
+
+	publisher := newRecordingPublisher()
+	p := newTestPipeline(t, withStore(store), withPublisher(publisher), withLedger(ledger))
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+		t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+	}
+	first := publisher.sent("downloader_dispatcher")
+	if len(first) != 1 {
+		t.Fatalf("got %d messages on downloader_dispatcher, want 1 (failures: %s)", len(first), publisher.sent(failureQueue))
+	}
+
+	// The redelivery is answered from the ledger, a download would fail to find the analysis
+	redelivered := newRecordingPublisher()
+	p = newTestPipeline(t, withPublisher(redelivered), withLedger(ledger))
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body, Redelivered: true}, p, true); action != actionAck {
+		t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+	}
+	if n := len(redelivered.sent(failureQueue)); n != 0 {
+		t.Errorf("got %d failure messages, want none", n)
+	}
+	if sent := redelivered.sent("downloader_dispatcher"); len(sent) != 1 || string(sent[0]) != string(first[0]) {
+		t.Errorf("published %q again, want %q", sent, first[0])
+	}
+}
+
+func TestDispatchPostponesDownloadInProgress(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+
+	store := NewMemoryStore()
+	message := newFileProjectFixture(t, store, root, "", "", map[string]string{"package.json": `{}`})
+	body, _ := json.Marshal(message)
+	ledger := NewMemoryLedger(time.Hour)
+	// Another downloader claims the analysis and never finishes
+	if _, claimed, _ := ledger.Claim(context.Background(), message.AnalysisId); !claimed {
+		t.Fatal("Claim() refused a new analysis")
+	}
+
+	publisher := newRecordingPublisher()
+	p := newTestPipeline(t, withStore(store), withPublisher(publisher), withLedger(ledger))
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionPostpone {
+		t.Fatalf("dispatch() = %v, want %v", action, actionPostpone)
+	}
+	if n := len(publisher.sent("downloader_dispatcher")) + len(publisher.sent(failureQueue)); n != 0 {
+		t.Errorf("got %d messages for a download in progress, want none", n)
+	}
+
+	// Once the download is stale, the postponed message takes it over
+	entry := ledger.entries[message.AnalysisId]
+	entry.UpdatedAt = time.Now().Add(-2 * time.Hour)
+	ledger.entries[message.AnalysisId] = entry
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+		t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+	}
+	if n := len(publisher.sent("downloader_dispatcher")); n != 1 {
+		t.Errorf("got %d messages on downloader_dispatcher, want 1 (failures: %s)", n, publisher.sent(failureQueue))
+	}
+	if entry := ledger.entries[message.AnalysisId]; entry.State != LedgerPublished || entry.Attempts != 2 {
+		t.Errorf("ledger entry = %+v, want the second attempt published", entry)
+	}
+}
+
+// failingPublisher is a recordingPublisher failing to send on a queue while it is down.
+type failingPublisher struct {
+	*recordingPublisher
+	queue string
+	down  bool
+}
+
+func (p *failingPublisher) SendMessage(queueName string, data []byte) error {
+	if p.down && queueName == p.queue {
+		return errors.New("connection closed")
+	}
+	return p.recordingPublisher.SendMessage(queueName, data)
+}
+
+func TestDispatchRetriesUnsentResult(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+
+	store := NewMemoryStore()
+	message := newFileProjectFixture(t, store, root, "", "", map[string]string{"package.json": `{}`})
+	body, _ := json.Marshal(message)
+	ledger := NewMemoryLedger(time.Hour)
+	publisher := &failingPublisher{recordingPublisher: newRecordingPublisher(), queue: "downloader_dispatcher", down: true}
+	p := newTestPipeline(t, withStore(store), withPublisher(publisher), withLedger(ledger))
+
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionRequeue {
+		t.Fatalf("dispatch() = %v, want %v", action, actionRequeue)
+	}
+	if entry := ledger.entries[message.AnalysisId]; entry.State != LedgerFetched || entry.Result == "" {
+		t.Fatalf("ledger entry = %+v, want the result kept as fetched", entry)
+	}
+	if n := len(publisher.sent(failureQueue)); n != 0 {
+		t.Errorf("got %d failure messages before the last attempt, want none", n)
+	}
+
+	// The last attempt still cannot send it and gives up
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, false); action != actionAck {
+		t.Errorf("dispatch() = %v, want %v", action, actionAck)
+	}
+	if len(publisher.sent(failureQueue)) != 1 || len(publisher.sent(deadLetterQueue)) != 1 {
+		t.Errorf("got %d failure messages and %d dead letters, want 1 each", len(publisher.sent(failureQueue)), len(publisher.sent(deadLetterQueue)))
+	}
+
+	// Once the broker is back, the stored result is published without downloading again
+	publisher.down = false
+	p.store = NewMemoryStore()
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body, Redelivered: true}, p, true); action != actionAck {
+		t.Errorf("dispatch() = %v, want %v", action, actionAck)
+	}
+	if sent := publisher.sent("downloader_dispatcher"); len(sent) != 1 || string(sent[0]) != ledger.entries[message.AnalysisId].Result {
+		t.Errorf("published %q, want the stored result", sent)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// ErrWorkspaceLocked is returned when a workspace stayed locked by another download for too long.
+var ErrWorkspaceLocked = errors.New("workspace is locked by another download")
+
+const (
+	// workspaceLockTimeout bounds the time a download waits for the workspace it downloads into.
+	workspaceLockTimeout = 5 * time.Minute
+	// maxLockPollInterval caps the delay between two attempts at taking a lock.
+	maxLockPollInterval = time.Second
+)
+
+// WorkspaceLocker serializes the downloads writing to the same workspace.
+// Locks are keyed on the path of the workspace.
+type WorkspaceLocker interface {
+	// Lock blocks until path is locked or ctx is done, and returns the function releasing the lock.
+	// It returns an error wrapping ErrWorkspaceLocked if ctx is done first.
+	Lock(ctx context.Context, path string) (func(), error)
+}
+
+// newWorkspaceLocker returns the WorkspaceLocker selected by DOWNLOADER_WORKSPACE_LOCK:
+// "file" (the default) for a single node, or "postgres" for replicas sharing the download root.
+func newWorkspaceLocker(layout WorkspaceLayout, db func() *bun.DB) WorkspaceLocker {
+	switch kind := os.Getenv("DOWNLOADER_WORKSPACE_LOCK"); kind {
+	case "postgres":
+		return NewAdvisoryLocker(layout.Root, db)
+	case "", "file":
+		return FileLocker{}
+	default:
+		log.Printf("Unknown workspace lock %q, using file locks", kind)
+		return FileLocker{}
+	}
+}
+
+// lockWorkspaces locks paths in order, waiting at most workspaceLockTimeout for all of them.
+// Paths must always be given in the same order, the mirror of a project before its workspaces.
+// A nil locker does not lock anything. A timeout is reported as a DownloadError of stage.
+func lockWorkspaces(ctx context.Context, locker WorkspaceLocker, stage DownloadStage, paths ...string) (func(), error) {
+	var unlocks []func()
+	unlock := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	if locker == nil {
+		return unlock, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, workspaceLockTimeout)
+	defer cancel()
+	for _, path := range paths {
+		release, err := locker.Lock(ctx, path)
+		if err != nil {
+			unlock()
+			return nil, newDownloadError(stage, CodeWorkspaceLocked, fmt.Errorf("failed to lock %s: %w", path, err))
+		}
+		unlocks = append(unlocks, release)
+	}
+	return unlock, nil
+}
+
+// waitForLock calls try until it takes the lock or ctx is done, backing off between attempts.
+func waitForLock(ctx context.Context, try func() (bool, error)) error {
+	interval := 50 * time.Millisecond
+	for {
+		locked, err := try()
+		if err != nil || locked {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrWorkspaceLocked, ctx.Err())
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, maxLockPollInterval)
+	}
+}
+
+// FileLocker locks workspaces with flock on a lock file next to them, "<workspace>.lock".
+// Branch names cannot end with ".lock", so lock files never collide with workspaces.
+// It only serializes the downloads of a single node.
+type FileLocker struct{}
+
+// Lock implements WorkspaceLocker.
+func (FileLocker) Lock(ctx context.Context, path string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	// Lock files are never removed, as another download may be waiting on them
+	file, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	err = waitForLock(ctx, func() (bool, error) {
+		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// AdvisoryLocker locks workspaces with Postgres advisory locks, serializing the downloads
+// of every replica sharing the download root.
+// Keys are the paths of the workspaces relative to the root, hashed by Postgres.
+type AdvisoryLocker struct {
+	root string
+	db   func() *bun.DB
+}
+
+// NewAdvisoryLocker creates an AdvisoryLocker for the workspaces under root.
+// The database is obtained on each lock since the connection may be replaced.
+func NewAdvisoryLocker(root string, db func() *bun.DB) *AdvisoryLocker {
+	return &AdvisoryLocker{root: root, db: db}
+}
+
+// Lock implements WorkspaceLocker.
+func (l *AdvisoryLocker) Lock(ctx context.Context, path string) (func(), error) {
+	key := l.key(path)
+
+	// Advisory locks belong to a session, so the same connection must take and release them
+	conn, err := l.db().Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a database connection: %w", err)
+	}
+
+	err = waitForLock(ctx, func() (bool, error) {
+		var locked bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtextextended(?, 0))", key).Scan(&locked)
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return false, fmt.Errorf("%w: %w", ErrWorkspaceLocked, err)
+		}
+		return locked, err
+	})
+	if err != nil {
+		// The lock may have been taken by an interrupted query
+		discardConn(conn)
+		return nil, err
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock(hashtextextended(?, 0))", key); err != nil {
+			log.Printf("Failed to unlock %s, closing its session: %v", path, err)
+			discardConn(conn)
+			return
+		}
+		conn.Close()
+	}, nil
+}
+
+// key returns the key of the advisory lock of the workspace at path, which is the same on every replica.
+func (l *AdvisoryLocker) key(path string) string {
+	key, err := filepath.Rel(l.root, path)
+	if err != nil {
+		key = path
+	}
+	return "downloader:" + filepath.ToSlash(key)
+}
+
+// discardConn closes the session of conn instead of returning it to the pool,
+// which releases the advisory locks it holds.
+func discardConn(conn bun.Conn) {
+	conn.Raw(func(any) error { return driver.ErrBadConn })
+	conn.Close()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/pgdialect"
+)
+
+func TestFileLockerWaitsForRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "projects", "main")
+	locker := FileLocker{}
+
+	unlock, err := locker.Lock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = lockWorkspaces(ctx, locker, StageClone, path)
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.Code != CodeWorkspaceLocked || !errors.Is(err, ErrWorkspaceLocked) {
+		t.Fatalf("lockWorkspaces() error = %v, want %s", err, CodeWorkspaceLocked)
+	}
+
+	// The lock is taken as soon as it is released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+	relock, err := lockWorkspaces(context.Background(), locker, StageClone, path)
+	if err != nil {
+		t.Fatalf("lockWorkspaces() error = %v", err)
+	}
+	relock()
+}
+
+func TestConcurrentFetchesOfSameWorkspace(t *testing.T) {
+	remote := newFixtureRepo(t, map[string]string{"package.json": `{}`})
+	commit := runTestGit(t, remote, "rev-parse", "HEAD")
+
+	for _, strategy := range []CloneStrategy{CloneFull, CloneMirror} {
+		t.Run(string(strategy), func(t *testing.T) {
+			strategies := defaultCloneStrategies()
+			strategies.Default = strategy
+			fetcher := gitFetcher{layout: WorkspaceLayout{Root: t.TempDir()}, strategies: strategies, locker: FileLocker{}}
+			project := codeclarity.Project{Id: uuid.New(), Type: "SVN", Url: "file://" + remote}
+			organization := uuid.New()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 4)
+			for i := 0; i < cap(errs); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					analysis := codeclarity.Analysis{Id: uuid.New(), Branch: "main"}
+					result, err := fetcher.Fetch(context.Background(), FetchRequest{Analysis: analysis, Project: project, Organization: organization})
+					if err == nil && result.Revision != commit {
+						err = errors.New("fetched revision " + result.Revision)
+					}
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("Fetch() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAdvisoryLockerKey(t *testing.T) {
+	var tests = []struct {
+		root string
+		path string
+		want string
+	}{
+		{"/data", "/data/org/projects/p/branch-main", "downloader:org/projects/p/branch-main"},
+		{"/data/", "/data/org/projects/p/.mirror.git", "downloader:org/projects/p/.mirror.git"},
+		// Replicas may mount the download root at different places, the key only depends on the path under it
+		{"/mnt/data", "/mnt/data/org/projects/p/branch-main", "downloader:org/projects/p/branch-main"},
+		{"/data", "org/projects/p/branch-main", "downloader:org/projects/p/branch-main"},
+	}
+	for _, tt := range tests {
+		if got := NewAdvisoryLocker(tt.root, nil).key(tt.path); got != tt.want {
+			t.Errorf("key(%q) under %q = %q, want %q", tt.path, tt.root, got, tt.want)
+		}
+	}
+}
+
+func TestAdvisoryLockerWaitsForRelease(t *testing.T) {
+	locks := newFakeAdvisoryLocks()
+	db := bun.NewDB(sql.OpenDB(locks), pgdialect.New())
+	defer db.Close()
+	root := t.TempDir()
+	locker := NewAdvisoryLocker(root, func() *bun.DB { return db })
+	path := filepath.Join(root, "org", "projects", "p", "branch-main")
+
+	unlock, err := locker.Lock(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	if holder := locks.holder("downloader:org/projects/p/branch-main"); holder == nil {
+		t.Fatalf("no session holds the lock of %s, locks = %v", path, locks.keys())
+	}
+
+	// Another session keeps trying until the timeout, then its session is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err = lockWorkspaces(ctx, locker, StageClone, path)
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.Code != CodeWorkspaceLocked || !errors.Is(err, ErrWorkspaceLocked) {
+		t.Fatalf("lockWorkspaces() error = %v, want %s", err, CodeWorkspaceLocked)
+	}
+	if attempts, closed := locks.stats(); attempts < 2 || closed != 1 {
+		t.Errorf("made %d attempts and closed %d sessions, want several attempts and the waiting session closed", attempts, closed)
+	}
+
+	// The lock is taken as soon as it is released
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		unlock()
+	}()
+	relock, err := lockWorkspaces(context.Background(), locker, StageClone, path)
+	if err != nil {
+		t.Fatalf("lockWorkspaces() error = %v", err)
+	}
+	relock()
+	if keys := locks.keys(); len(keys) != 0 {
+		t.Errorf("locks %v still held after being released", keys)
+	}
+}
+
+// fakeAdvisoryLocks is a database/sql connector whose sessions take and release
+// advisory locks like Postgres does, the locks of a session being released when it is closed.
+type fakeAdvisoryLocks struct {
+	mu       sync.Mutex
+	holders  map[string]*fakeSession
+	attempts int
+	closed   int
+}
+
+func newFakeAdvisoryLocks() *fakeAdvisoryLocks {
+	return &fakeAdvisoryLocks{holders: make(map[string]*fakeSession)}
+}
+
+func (l *fakeAdvisoryLocks) Connect(context.Context) (driver.Conn, error) {
+	return &fakeSession{locks: l}, nil
+}
+
+func (l *fakeAdvisoryLocks) Driver() driver.Driver { return nil }
+
+func (l *fakeAdvisoryLocks) holder(key string) *fakeSession {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holders[key]
+}
+
+func (l *fakeAdvisoryLocks) keys() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.Collect(maps.Keys(l.holders))
+}
+
+func (l *fakeAdvisoryLocks) stats() (attempts int, closed int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attempts, l.closed
+}
+
+// advisoryLockQuery extracts the function and the key of the queries of AdvisoryLocker.
+var advisoryLockQuery = regexp.MustCompile(`^SELECT (pg_try_advisory_lock|pg_advisory_unlock)\(hashtextextended\('([^']*)', 0\)\)$`)
+
+// fakeSession is a session of fakeAdvisoryLocks.
+type fakeSession struct {
+	locks *fakeAdvisoryLocks
+}
+
+func (s *fakeSession) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	match := advisoryLockQuery.FindStringSubmatch(query)
+	if match == nil || len(args) != 0 {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	key := match[2]
+	holder := s.locks.holders[key]
+	if match[1] == "pg_advisory_unlock" {
+		if holder == s {
+			delete(s.locks.holders, key)
+		}
+		return &fakeRows{value: holder == s}, nil
+	}
+	s.locks.attempts++
+	if holder == nil {
+		s.locks.holders[key] = s
+	}
+	return &fakeRows{value: holder == nil || holder == s}, nil
+}
+
+func (s *fakeSession) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	rows, err := s.QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), rows.Close()
+}
+
+func (s *fakeSession) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (s *fakeSession) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (s *fakeSession) Close() error {
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	s.locks.closed++
+	for key, holder := range s.locks.holders {
+		if holder == s {
+			delete(s.locks.holders, key)
+		}
+	}
+	return nil
+}
+
+// fakeRows holds the single boolean returned by the queries of a fakeSession.
+type fakeRows struct {
+	value bool
+	read  bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"result"} }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	dest[0] = r.value
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+	"github.com/google/uuid"
+)
+
+// DownloadResultMessage is sent on "downloader_dispatcher" once a project is downloaded.
+// It extends DownloaderDispatcherMessage, whose fields it inlines, with metadata about the download
+// so that downstream plugins do not have to recompute it.
+type DownloadResultMessage struct {
+	types_amqp.DownloaderDispatcherMessage
+	// WorkspacePath is the absolute path of the directory the project was downloaded into
+	WorkspacePath string `json:"workspace_path"`
+	// Source tells how the project was downloaded, "git" or "archive"
+	Source SourceType `json:"source"`
+	// Branch is the branch that was downloaded, which is the default branch of the remote
+	// for analyses without a branch
+	Branch string `json:"branch,omitempty"`
+	// Revision is the full commit SHA for git projects, or the content hash of the uploaded archive
+	Revision string `json:"revision"`
+	// Commit describes the downloaded commit, for git projects only
+	Commit *CommitInfo `json:"commit,omitempty"`
+	// DurationMs is the time the download took, from the lookups to the scan of the workspace
+	DurationMs int64 `json:"download_duration_ms"`
+	// WorkspaceStats describes the files of the workspace, its warnings include those of the download
+	WorkspaceStats
+}
+
+// AnalysisCancelMessage is published on the "analysis_cancel" exchange when an analysis is canceled.
+// Its download is aborted and no message is sent for it.
+type AnalysisCancelMessage struct {
+	AnalysisId uuid.UUID `json:"analysis_id"`
+}
@@ -0,0 +1,6 @@
+-- The commit an analysis was downloaded at, as a CommitInfo:
+-- {"sha": "...", "author": "...", "committed_at": "<RFC 3339>", "subject": "..."}
+-- It stays null for uploaded projects and is distinct from commit_hash, the commit the analysis requested.
+ALTER TABLE analysis ADD COLUMN IF NOT EXISTS downloaded_commit jsonb;
+
+-- Down: ALTER TABLE analysis DROP COLUMN IF EXISTS downloaded_commit;
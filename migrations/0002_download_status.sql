@@ -0,0 +1,19 @@
+-- The live status of the download of each analysis, written by the downloader and shown by the API.
+-- phase is one of queued, cloning, checking_out, extracting, detecting, retrying, done or failed;
+-- finished_at is only set once the phase is done or failed.
+CREATE TABLE IF NOT EXISTS download_status (
+    analysis_id uuid NOT NULL REFERENCES analysis (id) ON DELETE CASCADE,
+    phase varchar NOT NULL,
+    percent bigint NOT NULL,
+    count bigint NOT NULL,
+    total bigint NOT NULL,
+    bytes bigint NOT NULL,
+    message varchar,
+    started_at timestamptz NOT NULL,
+    phase_started_at timestamptz NOT NULL,
+    updated_at timestamptz NOT NULL,
+    finished_at timestamptz,
+    PRIMARY KEY (analysis_id)
+);
+
+-- Down: DROP TABLE IF EXISTS download_status;
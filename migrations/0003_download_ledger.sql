@@ -0,0 +1,16 @@
+-- The ledger of the downloads, so that redelivered messages are not downloaded and published twice.
+-- It is only used by the downloader, whose replicas claim analyses in it.
+-- state is one of received, fetching, fetched, published or failed;
+-- result is the message published to the dispatcher once the project is fetched.
+CREATE TABLE IF NOT EXISTS download_ledger (
+    analysis_id uuid NOT NULL,
+    state varchar NOT NULL,
+    owner varchar NOT NULL,
+    attempts bigint NOT NULL,
+    result varchar,
+    error varchar,
+    updated_at timestamptz NOT NULL,
+    PRIMARY KEY (analysis_id)
+);
+
+-- Down: DROP TABLE IF EXISTS download_ledger;
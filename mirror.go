@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitWorktree prepares destination as a worktree of the bare mirror of url, checked out
+// at the commit or the tip of the branch of analysis.
+// The mirror is created on first use and fetched incrementally afterwards, so that analyses of
+// the same project share its history instead of cloning it again.
+// A destination that is already a worktree of the mirror is reset and cleaned in place,
+// anything else is wiped first.
+func gitWorktree(git *gitSession, branch string, commit string, url string, mirror string, destination string) (WorkspaceAction, error) {
+	if mirror == "" {
+		return "", newDownloadError(StageClone, CodeCloneFailed, errors.New("no mirror to clone"))
+	}
+	if commit == "" && branch == "" {
+		return "", newDownloadError(StageClone, CodeCloneFailed, errors.New("no branch to clone"))
+	}
+
+	if err := git.syncMirror(mirror, url); err != nil {
+		return "", newDownloadError(StageClone, CodeCloneFailed, err)
+	}
+
+	target := "refs/heads/" + branch
+	if commit != "" {
+		target = commit
+		if !git.hasCommit(mirror, commit) {
+			// Commits no ref points to can only be fetched by their full hash
+			if err := git.run(mirror, "fetch", "origin", commit); err != nil || !git.hasCommit(mirror, commit) {
+				return "", newDownloadError(StageCheckout, CodeCommitNotFound, fmt.Errorf("%w: %s", ErrCommitNotFound, commit))
+			}
+		}
+	}
+	revision, err := git.read(mirror, "rev-parse", "--verify", "--quiet", target+"^{commit}")
+	if err != nil {
+		return "", newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("%s not found on the remote", target))
+	}
+
+	action := WorkspaceCloned
+	if _, err := os.Stat(destination); err == nil {
+		if git.isWorktreeOf(destination, mirror) {
+			for _, args := range [][]string{
+				{"checkout", "--force", "--detach", revision},
+				{"clean", "-ffdx"},
+			} {
+				if err := git.run(destination, args...); err != nil {
+					return "", newDownloadError(StageCheckout, CodeCheckoutFailed, fmt.Errorf("git %s failed: %w", args[0], err))
+				}
+			}
+			if err := git.updateSubmodules(destination); err != nil {
+				return "", newDownloadError(StageCheckout, CodeCheckoutFailed, err)
+			}
+			return WorkspaceUpdated, nil
+		}
+		log.Printf("Workspace %s is not a worktree of %s, wiping it", destination, mirror)
+		if err := os.RemoveAll(destination); err != nil {
+			return "", newDownloadError(StageClone, CodeCloneFailed, fmt.Errorf("failed to wipe workspace: %w", err))
+		}
+		action = WorkspaceRecloned
+	}
+
+	// Forget worktrees whose directory was removed, including a previous one at destination
+	for _, args := range [][]string{
+		{"worktree", "prune"},
+		{"worktree", "add", "--force", "--detach", destination, revision},
+	} {
+		if err := git.run(mirror, args...); err != nil {
+			return "", newDownloadError(StageCheckout, CodeCheckoutFailed, fmt.Errorf("git worktree %s failed: %w", args[1], err))
+		}
+	}
+	if err := git.updateSubmodules(destination); err != nil {
+		return "", newDownloadError(StageCheckout, CodeCheckoutFailed, err)
+	}
+	return action, nil
+}
+
+// syncMirror fetches every ref of url into the bare repository mirror, creating it if needed.
+// It returns an error wrapping errFetchFailed if the remote could not be fetched.
+func (s *gitSession) syncMirror(mirror string, url string) error {
+	if s.isMirrorOf(mirror, url) {
+		// Drop any credentials stored in the remote URL
+		if err := s.run(mirror, "remote", "set-url", "origin", url); err != nil {
+			return fmt.Errorf("git remote set-url failed: %w", err)
+		}
+	} else {
+		if err := os.RemoveAll(mirror); err != nil {
+			return fmt.Errorf("failed to wipe mirror: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(mirror), 0755); err != nil {
+			return fmt.Errorf("failed to create project directory: %w", err)
+		}
+		if err := s.run("", "init", "--quiet", "--bare", mirror); err != nil {
+			return fmt.Errorf("git init failed: %w", err)
+		}
+		// Fetching +refs/*:refs/* also brings the pull and merge request refs
+		if err := s.run(mirror, "remote", "add", "--mirror=fetch", "origin", url); err != nil {
+			return fmt.Errorf("git remote add failed: %w", err)
+		}
+	}
+
+	if err := s.run(mirror, "fetch", "--prune", "origin"); err != nil {
+		return fmt.Errorf("%w: %w", errFetchFailed, err)
+	}
+	return nil
+}
+
+// isMirrorOf reports whether dir is a bare repository whose origin is url.
+func (s *gitSession) isMirrorOf(dir string, url string) bool {
+	if _, err := os.Stat(dir); err != nil {
+		return false
+	}
+	gitDir, err := s.read(dir, "rev-parse", "--absolute-git-dir")
+	if err != nil || !samePath(gitDir, dir) {
+		return false
+	}
+	if bare, err := s.read(dir, "rev-parse", "--is-bare-repository"); err != nil || bare != "true" {
+		return false
+	}
+	origin, err := s.read(dir, "config", "--get", "remote.origin.url")
+	return err == nil && normalizeRemoteURL(origin) == normalizeRemoteURL(url)
+}
+
+// isWorktreeOf reports whether dir is the top level of a worktree of the repository mirror.
+func (s *gitSession) isWorktreeOf(dir string, mirror string) bool {
+	topLevel, err := s.read(dir, "rev-parse", "--show-toplevel")
+	if err != nil || !samePath(topLevel, dir) {
+		return false
+	}
+	commonDir, err := s.read(dir, "rev-parse", "--path-format=absolute", "--git-common-dir")
+	return err == nil && samePath(commonDir, mirror)
+}
+
+// isLinkedWorktree reports whether dir is a worktree sharing the repository of another one.
+func (s *gitSession) isLinkedWorktree(dir string) bool {
+	out, err := s.read(dir, "rev-parse", "--path-format=absolute", "--git-dir", "--git-common-dir")
+	if err != nil {
+		return false
+	}
+	gitDir, commonDir, _ := strings.Cut(out, "\n")
+	return !samePath(gitDir, commonDir)
+}
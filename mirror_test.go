@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+// newMirrorFetcher returns a gitFetcher cloning every project with CloneMirror into a temporary layout.
+func newMirrorFetcher(t *testing.T) gitFetcher {
+	strategies := defaultCloneStrategies()
+	strategies.ByProjectType["GITHUB"] = CloneMirror
+	return gitFetcher{layout: WorkspaceLayout{Root: t.TempDir()}, strategies: strategies, locker: FileLocker{}}
+}
+
+func TestGitMirrorWorktrees(t *testing.T) {
+	remote := newFixtureRepo(t, map[string]string{"package.json": `{}`})
+	first := runTestGit(t, remote, "rev-parse", "HEAD")
+	runTestGit(t, remote, "checkout", "-q", "-b", "feature")
+	onFeature := commitFiles(t, remote, map[string]string{"feature.txt": "feature"}, "feature")
+	runTestGit(t, remote, "checkout", "-q", "main")
+
+	fetcher := newMirrorFetcher(t)
+	organization := uuid.New()
+	project := codeclarity.Project{Id: uuid.New(), Type: "GITHUB", Url: "file://" + remote}
+	mirror := fetcher.layout.MirrorPath(organization, project.Id)
+	fetch := func(t *testing.T, analysis codeclarity.Analysis) FetchResult {
+		t.Helper()
+		analysis.Id = uuid.New()
+		result, err := fetcher.Fetch(context.Background(), FetchRequest{Analysis: analysis, Project: project, Organization: organization})
+		if err != nil {
+			t.Fatalf("Fetch() error = %v", err)
+		}
+		if commonDir := runTestGit(t, result.Path, "rev-parse", "--path-format=absolute", "--git-common-dir"); !samePath(commonDir, mirror) {
+			t.Errorf("workspace shares %s, want the mirror %s", commonDir, mirror)
+		}
+		return result
+	}
+
+	main := fetch(t, codeclarity.Analysis{Branch: "main"})
+	if main.Revision != first || main.Metadata["workspace_action"] != string(WorkspaceCloned) {
+		t.Errorf("main = %s %s, want %s %s", main.Metadata["workspace_action"], main.Revision, WorkspaceCloned, first)
+	}
+	if bare := runTestGit(t, mirror, "rev-parse", "--is-bare-repository"); bare != "true" {
+		t.Errorf("mirror is not bare")
+	}
+
+	// A commit of another branch gets its own worktree of the same mirror
+	feature := fetch(t, codeclarity.Analysis{Branch: "main", Commit: onFeature[:10]})
+	if feature.Revision != onFeature || !fileExists(filepath.Join(feature.Path, "feature.txt")) {
+		t.Errorf("feature = %s, want %s", feature.Revision, onFeature)
+	}
+	if fileExists(filepath.Join(main.Path, "feature.txt")) {
+		t.Error("checking out the feature commit changed the main worktree")
+	}
+
+	// New commits are fetched into the mirror and the existing worktree is moved to them
+	second := commitFiles(t, remote, map[string]string{"composer.json": `{}`}, "second")
+	if err := os.WriteFile(filepath.Join(main.Path, "untracked.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	updated := fetch(t, codeclarity.Analysis{Branch: "main"})
+	if updated.Revision != second || updated.Metadata["workspace_action"] != string(WorkspaceUpdated) {
+		t.Errorf("update = %s %s, want %s %s", updated.Metadata["workspace_action"], updated.Revision, WorkspaceUpdated, second)
+	}
+	if fileExists(filepath.Join(main.Path, "untracked.txt")) {
+		t.Error("untracked file survived the update")
+	}
+
+	// A workspace cloned with another strategy is replaced by a worktree
+	strategies := defaultCloneStrategies()
+	full := gitFetcher{layout: fetcher.layout, strategies: strategies}
+	request := FetchRequest{Analysis: codeclarity.Analysis{Id: uuid.New(), Branch: "main", Commit: first}, Project: project, Organization: organization}
+	if _, err := full.Fetch(context.Background(), request); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if result := fetch(t, codeclarity.Analysis{Branch: "main", Commit: first}); result.Metadata["workspace_action"] != string(WorkspaceRecloned) {
+		t.Errorf("workspace_action = %s, want %s", result.Metadata["workspace_action"], WorkspaceRecloned)
+	}
+}
+
+func TestCleanupRemovesUnusedWorktrees(t *testing.T) {
+	remote := newFixtureRepo(t, map[string]string{"package.json": `{}`})
+	commit := runTestGit(t, remote, "rev-parse", "HEAD")
+
+	fetcher := newMirrorFetcher(t)
+	organization := uuid.New()
+	project := codeclarity.Project{Id: uuid.New(), Type: "GITHUB", Url: "file://" + remote}
+	mirror := fetcher.layout.MirrorPath(organization, project.Id)
+
+	first, second, pinned := uuid.New(), uuid.New(), uuid.New()
+	paths := make(map[uuid.UUID]string)
+	for id, analysis := range map[uuid.UUID]codeclarity.Analysis{
+		first:  {Branch: "main"},
+		second: {Branch: "main"},
+		pinned: {Branch: "main", Commit: commit},
+	} {
+		analysis.Id = id
+		result, err := fetcher.Fetch(context.Background(), FetchRequest{Analysis: analysis, Project: project, Organization: organization})
+		if err != nil {
+			t.Fatalf("Fetch() error = %v", err)
+		}
+		paths[id] = result.Path
+	}
+	cleanup := func(analysis uuid.UUID) {
+		t.Helper()
+		if err := cleanupAnalysis(fetcher.layout, FileLocker{}, organization, project.Id, analysis); err != nil {
+			t.Fatalf("cleanupAnalysis() error = %v", err)
+		}
+	}
+
+	// The main workspace is still used by the second analysis
+	cleanup(first)
+	if !fileExists(paths[first]) {
+		t.Fatal("workspace removed while still in use")
+	}
+
+	cleanup(second)
+	if fileExists(paths[second]) {
+		t.Error("unused workspace was not removed")
+	}
+	if worktrees := runTestGit(t, mirror, "worktree", "list", "--porcelain"); strings.Contains(worktrees, paths[second]) {
+		t.Errorf("removed workspace is still a worktree of the mirror:\n%s", worktrees)
+	}
+	if !fileExists(paths[pinned]) {
+		t.Error("workspace of another analysis was removed")
+	}
+
+	// Analyses without workspaces are ignored
+	cleanup(uuid.New())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// progressExchange is the fanout exchange on which the progress of downloads is streamed to the UI.
+	progressExchange = "downloader_progress"
+	// progressInterval is the minimum delay between two events of a download within the same phase.
+	progressInterval = 500 * time.Millisecond
+	// progressBuffer is the number of events waiting to be published before new ones are dropped.
+	progressBuffer = 256
+	// progressPublishTimeout bounds the publication of an event.
+	progressPublishTimeout = 5 * time.Second
+)
+
+// ProgressEvent is published on the progressExchange as a download progresses.
+type ProgressEvent struct {
+	AnalysisId uuid.UUID     `json:"analysis_id"`
+	Stage      DownloadPhase `json:"stage"`
+	Percent    int           `json:"percent"`
+	Count      int64         `json:"count"`
+	Total      int64         `json:"total"`
+	Bytes      int64         `json:"bytes"`
+	Time       time.Time     `json:"time"`
+}
+
+// progressBroadcaster publishes ProgressEvents in the background, over a connection of its own
+// since ServiceBase only publishes on queues. Events are dropped rather than delaying downloads
+// when the broker is slow or unreachable. A nil progressBroadcaster drops every event.
+type progressBroadcaster struct {
+	events chan ProgressEvent
+}
+
+// newProgressBroadcaster creates a progressBroadcaster, whose events are published once it runs.
+func newProgressBroadcaster() *progressBroadcaster {
+	return &progressBroadcaster{events: make(chan ProgressEvent, progressBuffer)}
+}
+
+// send queues event for publication, unless too many events are already waiting. It never blocks.
+func (b *progressBroadcaster) send(event ProgressEvent) {
+	if b == nil {
+		return
+	}
+	select {
+	case b.events <- event:
+	default:
+	}
+}
+
+// reporter returns the ProgressFunc sending the progress of the download of analysis,
+// at most one event every progressInterval within a phase.
+func (b *progressBroadcaster) reporter(analysis uuid.UUID) ProgressFunc {
+	if b == nil {
+		return nil
+	}
+	var mu sync.Mutex
+	var phase DownloadPhase
+	var sent time.Time
+	return func(current DownloadPhase, progress Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if current == phase && now.Sub(sent) < progressInterval {
+			return
+		}
+		phase, sent = current, now
+		b.send(ProgressEvent{
+			AnalysisId: analysis,
+			Stage:      current,
+			Percent:    progress.Percent,
+			Count:      progress.Count,
+			Total:      progress.Total,
+			Bytes:      progress.Bytes,
+			Time:       now.UTC(),
+		})
+	}
+}
+
+// run publishes the queued events on the progressExchange of the broker at url.
+// It reconnects whenever the connection is lost and never returns. Events keep being queued,
+// and dropped once the queue is full, while it reconnects.
+func (b *progressBroadcaster) run(url string) {
+	keepConnected(url, "publisher of "+progressExchange, b.publish)
+}
+
+// publish publishes the queued events on ch until its connection is lost.
+func (b *progressBroadcaster) publish(ch *amqp.Channel) error {
+	if err := ch.ExchangeDeclare(progressExchange, "fanout", true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	for {
+		select {
+		case err := <-closed:
+			return fmt.Errorf("connection closed: %v", err)
+		case event := <-b.events:
+			data, _ := json.Marshal(event)
+			ctx, cancel := context.WithTimeout(context.Background(), progressPublishTimeout)
+			// Events are transient, nobody may be listening
+			err := ch.PublishWithContext(ctx, progressExchange, "", false, false, amqp.Publishing{
+				ContentType: "application/json",
+				Body:        data,
+			})
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to publish event: %w", err)
+			}
+		}
+	}
+}
+
+// joinProgress returns a ProgressFunc calling each of funcs that is set.
+func joinProgress(funcs ...ProgressFunc) ProgressFunc {
+	return func(phase DownloadPhase, progress Progress) {
+		for _, f := range funcs {
+			f.report(phase, progress)
+		}
+	}
+}
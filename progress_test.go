@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// drainEvents returns the events queued on b.
+func drainEvents(b *progressBroadcaster) []ProgressEvent {
+	var events []ProgressEvent
+	for {
+		select {
+		case event := <-b.events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestProgressBroadcasterNeverBlocks(t *testing.T) {
+	broadcaster := newProgressBroadcaster()
+	done := make(chan struct{})
+	go func() {
+		// Nobody publishes the events, the extra ones are dropped
+		for i := 0; i < progressBuffer+10; i++ {
+			broadcaster.send(ProgressEvent{Percent: i})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send() blocked on a full queue")
+	}
+	if n := len(drainEvents(broadcaster)); n != progressBuffer {
+		t.Errorf("queued %d events, want %d", n, progressBuffer)
+	}
+
+	var none *progressBroadcaster
+	none.send(ProgressEvent{})
+	none.reporter(uuid.New()).report(PhaseCloning, Progress{})
+}
+
+func TestProgressReporterThrottles(t *testing.T) {
+	broadcaster := newProgressBroadcaster()
+	analysis := uuid.New()
+	report := broadcaster.reporter(analysis)
+
+	report(PhaseCloning, Progress{Percent: 10, Bytes: 1024})
+	report(PhaseCloning, Progress{Percent: 20})
+	report(PhaseCheckingOut, Progress{Percent: 5, Count: 1, Total: 20})
+
+	events := drainEvents(broadcaster)
+	if len(events) != 2 {
+		t.Fatalf("sent %d events, want 2", len(events))
+	}
+	if events[0].AnalysisId != analysis || events[0].Stage != PhaseCloning || events[0].Percent != 10 || events[0].Bytes != 1024 {
+		t.Errorf("first event = %+v, want cloning at 10%%", events[0])
+	}
+	if events[1].Stage != PhaseCheckingOut || events[1].Total != 20 {
+		t.Errorf("second event = %+v, want checking out", events[1])
+	}
+
+	time.Sleep(progressInterval)
+	report(PhaseCheckingOut, Progress{Percent: 50})
+	if events := drainEvents(broadcaster); len(events) != 1 || events[0].Percent != 50 {
+		t.Errorf("sent %+v after the interval, want checking out at 50%%", events)
+	}
+}
+
+func TestDispatchPublishesProgress(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+
+	store := NewMemoryStore()
+	message := newFileProjectFixture(t, store, root, "", "", map[string]string{"package.json": `{}`})
+	body, _ := json.Marshal(message)
+	broadcaster := newProgressBroadcaster()
+	p := newTestPipeline(t, withStore(store), withProgress(broadcaster))
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+		t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+	}
+
+	events := drainEvents(broadcaster)
+	want := []DownloadPhase{PhaseQueued, PhaseExtracting, PhaseDetecting, PhaseDone}
+	if len(events) != len(want) {
+		t.Fatalf("sent %+v, want the phases %v", events, want)
+	}
+	for i, event := range events {
+		if event.Stage != want[i] || event.AnalysisId != message.AnalysisId {
+			t.Errorf("event %d = %+v, want %s of analysis %s", i, event, want[i], message.AnalysisId)
+		}
+	}
+	if last := events[len(events)-1]; last.Percent != 100 {
+		t.Errorf("last event = %+v, want 100%%", last)
+	}
+}
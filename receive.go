@@ -1,98 +1,307 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
+	"time"
 
-	"github.com/CodeClarityCE/utility-boilerplates"
 	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+	"github.com/google/uuid"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// lookupTimeout bounds each database lookup made while processing a message, unless configured otherwise.
+const lookupTimeout = 10 * time.Second
+
+// pipeline groups the collaborators used to process a message.
+type pipeline struct {
+	store     ProjectStore
+	fetchers  *FetcherRegistry
+	publisher Publisher
+	timeouts  StageTimeouts
+	// cancellations aborts the downloads of canceled analyses
+	cancellations *cancelRegistry
+	// ledger keeps redelivered messages from being downloaded and published twice, if set
+	ledger Ledger
+	// statuses records the progress of downloads for the API, if set
+	statuses StatusStore
+	// progress streams the progress of downloads to the UI, if set
+	progress *progressBroadcaster
+}
+
+// deliveryAction tells the queue handler what to do with a processed message.
+type deliveryAction int
+
+const (
+	// actionAck means the message was processed, successfully or with a reported failure.
+	actionAck deliveryAction = iota
+	// actionReject means the message can never be processed and must not be requeued.
+	actionReject
+	// actionRequeue means the message failed for a transient reason and should be retried later.
+	actionRequeue
+	// actionPostpone means the analysis is being downloaded elsewhere, the message should be processed
+	// again once that download is published, failed or stale. It does not count as an attempt.
+	actionPostpone
+)
+
 // dispatch is a function that handles the received message from the "dispatcher_downloader" connection.
 // It reads the message from the API, retrieves analysis, project, and integration information,
 // downloads the project, and sends a message to the "downloader_dispatcher" connection.
+// If any step fails, a DownloaderFailureMessage is sent instead so the analysis does not hang.
+// Messages that cannot be decoded, of an unknown version or lacking an ID are dead-lettered,
+// along with the failure if they name an analysis.
+// If the analysis is canceled, its download is aborted and no message is sent at all.
+// Analyses already downloaded have their result published again, those being downloaded elsewhere are postponed.
 // Parameters:
+// - ctx: the context of the download, canceling it aborts every stage
 // - connection: a string representing the connection name
 // - d: an amqp.Delivery object containing the message data
-// - service: ServiceBase instance for sending messages
-// Returns: None
-func dispatch(connection string, d amqp.Delivery, service *boilerplates.ServiceBase) {
+// - p: pipeline providing the project store and the publisher for outgoing messages
+// - canRetry: whether a transient failure may be retried, on the last attempt it is reported and dead-lettered
+// Returns: the action the queue handler should take for the delivery
+func dispatch(ctx context.Context, connection string, d amqp.Delivery, p *pipeline, canRetry bool) deliveryAction {
 	if connection == "dispatcher_downloader" { // If message is from dispatcher
-		// Read message from API
-		var apiMessage types_amqp.DispatcherDownloaderMessage
-		json.Unmarshal([]byte(d.Body), &apiMessage)
-
-		// Get info
-		analysis_info, err := getAnalysis(service.DB.CodeClarity, apiMessage.AnalysisId)
+		// Read message from API, invalid messages are handed over to operators
+		apiMessage, err := decodeDispatcherMessage(d)
 		if err != nil {
-			log.Printf("%v", err)
-			// TODO: Send error message
-			return
+			log.Printf("Rejecting message: %v", err)
+			if apiMessage.AnalysisId != uuid.Nil {
+				// Failures without an analysis cannot be matched by the dispatcher
+				sendFailure(p.publisher, apiMessage, err)
+			}
+			sendDeadLetter(p.publisher, connection, d, err)
+			return actionReject
 		}
 
-		project_info, err := getProject(service.DB.CodeClarity, *analysis_info.ProjectId)
-		if err != nil {
-			log.Printf("%v", err)
-			return
+		ctx, done := p.cancellations.start(ctx, apiMessage.AnalysisId)
+		defer done()
+		if isCanceled(ctx) {
+			log.Printf("Analysis %s was canceled, skipping its download", apiMessage.AnalysisId)
+			return actionAck
 		}
-
-		// Handle based on project type
-		if project_info.Type == "FILE" {
-			// FILE project - extract uploaded archive
-			log.Printf("Processing FILE project: %s", project_info.Id)
-			err = Archive(analysis_info, project_info, apiMessage.OrganizationId)
-			if err != nil {
-				log.Printf("Failed to extract archive: %v", err)
-				// TODO Send error message
-				return
+		if claimed, stored := claimDownload(ctx, p, apiMessage.AnalysisId); !claimed {
+			if stored == "" {
+				return actionPostpone
 			}
-		} else {
-			// VCS project (GITHUB, GITLAB) - git clone
-			log.Printf("Processing VCS project: %s (type: %s)", project_info.Id, project_info.Type)
-			integration_info, err := getIntegration(service.DB.CodeClarity, apiMessage.IntegrationId)
-			if err != nil {
-				log.Printf("%v", err)
-				return
+			if canceledInStore(ctx, p, apiMessage.AnalysisId) {
+				log.Printf("Analysis %s was canceled, dropping its stored result", apiMessage.AnalysisId)
+				return actionAck
 			}
+			action, _ := publishResult(p, connection, d, apiMessage, []byte(stored), canRetry)
+			return action
+		}
 
-			err = Git(analysis_info, project_info, integration_info, apiMessage.OrganizationId)
+		status := newStatusReporter(p.statuses, apiMessage.AnalysisId, p.timeouts.Lookup)
+		events := p.progress.reporter(apiMessage.AnalysisId)
+		finish := func(err error, secrets ...string) {
+			status.finish(err, secrets...)
 			if err != nil {
-				log.Printf("Failed to clone repository: %v", err)
-				// TODO Send error message
-				return
+				events.report(PhaseFailed, Progress{})
+			} else {
+				events.report(PhaseDone, Progress{Percent: 100})
 			}
 		}
-
-		// Detect languages from the downloaded repository
-		// Build the project path where the repository was cloned
-		path := os.Getenv("DOWNLOAD_PATH")
-		destination := fmt.Sprintf("%s/%s/%s/%s", path, apiMessage.OrganizationId, "projects", project_info.Id)
-		if analysis_info.Commit == "" || analysis_info.Commit == " " {
-			destination = fmt.Sprintf("%s/%s", destination, analysis_info.Branch)
-		} else {
-			destination = fmt.Sprintf("%s/%s", destination, analysis_info.Commit)
+		retrying := func(err error, secrets ...string) {
+			status.retry(err, secrets...)
+			events.report(PhaseRetrying, Progress{})
+		}
+		progress := joinProgress(status.report, events)
+		progress(PhaseQueued, Progress{})
+		recordDownload(ctx, p, apiMessage.AnalysisId, LedgerFetching, "", "")
+		started := time.Now()
+		result, secrets, err := download(ctx, apiMessage, p, progress)
+		duration := time.Since(started)
+		canceled := isCanceled(ctx) || errors.Is(err, ErrAnalysisCanceled)
+		if !canceled && err == nil {
+			// The analysis may have been canceled while it was downloaded
+			canceled = canceledInStore(ctx, p, apiMessage.AnalysisId)
+		}
+		if canceled {
+			// The pipeline of a canceled analysis must not go on, even if the download completed
+			log.Printf("Analysis %s was canceled during its download", apiMessage.AnalysisId)
+			recordDownload(ctx, p, apiMessage.AnalysisId, LedgerFailed, "", ErrAnalysisCanceled.Error())
+			finish(ErrAnalysisCanceled)
+			return actionAck
+		}
+		if err != nil {
+			log.Printf("%v", redact(err.Error(), secrets...))
+			recordDownload(ctx, p, apiMessage.AnalysisId, LedgerFailed, "", redact(err.Error(), secrets...))
+			if retryable(err) && canRetry {
+				retrying(err, secrets...)
+				return actionRequeue
+			}
+			// The download failed for good, on its last attempt or for a permanent reason
+			finish(err, secrets...)
+			if retryable(err) {
+				giveUp(p.publisher, connection, d, apiMessage, err, secrets...)
+				return actionAck
+			}
+			sendFailure(p.publisher, apiMessage, err, secrets...)
+			if errors.Is(err, ErrNotFound) {
+				return actionReject
+			}
+			return actionAck
 		}
-
-		languageResult := detectLanguagesFromRepository(destination)
 
 		// Send message to dispatcher with language detection results
-		downloaderMessage := types_amqp.DownloaderDispatcherMessage{
-			AnalysisId:          apiMessage.AnalysisId,
-			ProjectId:           apiMessage.ProjectId,
-			IntegrationId:       apiMessage.IntegrationId,
-			OrganizationId:      apiMessage.OrganizationId,
-			DetectedLanguages:   languageResult.DetectedLanguages,
-			PrimaryLanguage:     languageResult.PrimaryLanguage,
-			DetectionConfidence: languageResult.DetectionConfidence,
+		downloaderMessage := DownloadResultMessage{
+			DownloaderDispatcherMessage: types_amqp.DownloaderDispatcherMessage{
+				AnalysisId:          apiMessage.AnalysisId,
+				ProjectId:           apiMessage.ProjectId,
+				IntegrationId:       apiMessage.IntegrationId,
+				OrganizationId:      apiMessage.OrganizationId,
+				DetectedLanguages:   result.languages.DetectedLanguages,
+				PrimaryLanguage:     result.languages.PrimaryLanguage,
+				DetectionConfidence: result.languages.DetectionConfidence,
+			},
+			WorkspacePath:  result.fetch.Path,
+			Source:         result.fetch.Source,
+			Branch:         result.fetch.Branch,
+			Revision:       result.fetch.Revision,
+			Commit:         result.fetch.Commit,
+			DurationMs:     duration.Milliseconds(),
+			WorkspaceStats: result.stats,
 		}
 		data, _ := json.Marshal(downloaderMessage)
-		err = service.SendMessage("downloader_dispatcher", data)
+		recordDownload(ctx, p, apiMessage.AnalysisId, LedgerFetched, string(data), "")
+		if action, err := publishResult(p, connection, d, apiMessage, data, canRetry); err != nil {
+			if action == actionRequeue {
+				retrying(err)
+			} else {
+				finish(err)
+			}
+			return action
+		}
+		recordDownload(ctx, p, apiMessage.AnalysisId, LedgerPublished, "", "")
+		finish(nil)
+	}
+
+	return actionAck
+}
+
+// publishResult sends data, the result of the download of apiMessage, to the dispatcher.
+// When it cannot be sent, the result is left in the ledger as fetched and d is retried,
+// its redelivery publishing the stored result; on the last attempt it is given up on.
+// It returns the action to take for d and the error the result could not be sent with.
+func publishResult(p *pipeline, connection string, d amqp.Delivery, apiMessage types_amqp.DispatcherDownloaderMessage, data []byte, canRetry bool) (deliveryAction, error) {
+	err := p.publisher.SendMessage("downloader_dispatcher", data)
+	if err == nil {
+		return actionAck, nil
+	}
+	err = newDownloadError(StagePublish, CodePublishFailed, fmt.Errorf("failed to send message to downloader_dispatcher: %w", err))
+	log.Printf("%v", err)
+	if canRetry {
+		return actionRequeue, err
+	}
+	giveUp(p.publisher, connection, d, apiMessage, err)
+	return actionAck, err
+}
+
+// downloadResult is what download produced for an analysis.
+type downloadResult struct {
+	fetch     FetchResult
+	languages LanguageDetectionResult
+	stats     WorkspaceStats
+}
+
+// download retrieves the analysis, project and integration referenced by apiMessage,
+// fetches the project sources, detects the languages they use and scans the workspace.
+// It also returns the secrets that must be redacted from any error it reports.
+// Each stage is bounded by the timeouts of p, a stage running out of time is reported with CodeTimedOut.
+// The progress of the fetch and detection is reported to progress.
+func download(ctx context.Context, apiMessage types_amqp.DispatcherDownloaderMessage, p *pipeline, progress ProgressFunc) (downloadResult, []string, error) {
+	// Get info
+	lookupCtx, cancel := withStageTimeout(ctx, p.timeouts.Lookup)
+	defer cancel()
+
+	analysis_info, err := p.store.GetAnalysis(lookupCtx, apiMessage.AnalysisId)
+	if err != nil {
+		return downloadResult{}, nil, timedOut(lookupCtx, StageLookup, lookupError(err))
+	}
+	if analysis_info.Status == analysisCanceled {
+		return downloadResult{}, nil, fmt.Errorf("analysis %s: %w", analysis_info.Id, ErrAnalysisCanceled)
+	}
+	if analysis_info.ProjectId == nil {
+		return downloadResult{}, nil, newDownloadError(StageLookup, CodeNotFound, fmt.Errorf("analysis %s has no project: %w", analysis_info.Id, ErrNotFound))
+	}
+
+	project_info, err := p.store.GetProject(lookupCtx, *analysis_info.ProjectId)
+	if err != nil {
+		return downloadResult{}, nil, timedOut(lookupCtx, StageLookup, lookupError(err))
+	}
+
+	fetcher, err := p.fetchers.Get(project_info.Type)
+	if err != nil {
+		return downloadResult{}, nil, newDownloadError(StageLookup, CodeUnsupportedProjectType, err)
+	}
+
+	request := FetchRequest{
+		Analysis:     analysis_info,
+		Project:      project_info,
+		Organization: apiMessage.OrganizationId,
+		Progress:     progress,
+	}
+	var secrets []string
+	if fetcher.RequiresIntegration() {
+		integrationCtx, cancel := withStageTimeout(ctx, p.timeouts.Lookup)
+		defer cancel()
+		request.Integration, err = p.store.GetIntegration(integrationCtx, apiMessage.IntegrationId)
 		if err != nil {
-			log.Printf("Failed to send message to downloader_dispatcher: %v", err)
+			return downloadResult{}, nil, timedOut(integrationCtx, StageLookup, lookupError(err))
+		}
+		secrets = append(secrets, request.Integration.AccessToken)
+		defaultRedactor.Add(secrets...)
+		defer defaultRedactor.Remove(secrets...)
+	}
+
+	log.Printf("Processing %s project: %s", project_info.Type, project_info.Id)
+	fetchResult, err := fetcher.Fetch(ctx, request)
+	if err != nil {
+		return downloadResult{}, secrets, err
+	}
+	log.Printf("Fetched project %s at revision %s", project_info.Id, fetchResult.Revision)
+
+	if fetchResult.Commit != nil {
+		saveCtx, cancel := withStageTimeout(ctx, p.timeouts.Lookup)
+		defer cancel()
+		if err := p.store.SaveCommit(saveCtx, analysis_info.Id, *fetchResult.Commit); err != nil {
+			// The download itself succeeded, the commit is still reported to the dispatcher
+			log.Printf("Failed to save commit of analysis %s: %v", analysis_info.Id, err)
 		}
 	}
 
+	// Detect languages from the downloaded repository
+	if _, err := os.Stat(fetchResult.Path); err != nil {
+		return downloadResult{}, secrets, newDownloadError(StageDetect, CodeDetectFailed, fmt.Errorf("downloaded project not found: %w", err))
+	}
+	// Plugins are given an absolute path whatever the download root
+	if path, err := filepath.Abs(fetchResult.Path); err == nil {
+		fetchResult.Path = path
+	}
+
+	progress.report(PhaseDetecting, Progress{})
+	stats, err := scanWorkspace(ctx, fetchResult.Path)
+	if err != nil {
+		return downloadResult{}, secrets, newDownloadError(StageDetect, CodeDetectFailed, fmt.Errorf("failed to scan the workspace: %w", err))
+	}
+	stats.Warnings = slices.Concat(fetchResult.Warnings, stats.Warnings)
+	return downloadResult{
+		fetch:     fetchResult,
+		languages: detectLanguagesFromRepository(fetchResult.Path),
+		stats:     stats,
+	}, secrets, nil
+}
+
+// lookupError wraps an error returned by a database lookup with the matching failure code.
+func lookupError(err error) *DownloadError {
+	if errors.Is(err, ErrNotFound) {
+		return newDownloadError(StageLookup, CodeNotFound, err)
+	}
+	return newDownloadError(StageLookup, CodeLookupFailed, err)
 }
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recordingPublisher is a Publisher keeping every message sent, by queue.
+type recordingPublisher struct {
+	mu       sync.Mutex
+	messages map[string][][]byte
+}
+
+func newRecordingPublisher() *recordingPublisher {
+	return &recordingPublisher{messages: make(map[string][][]byte)}
+}
+
+func (p *recordingPublisher) SendMessage(queueName string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.messages[queueName] = append(p.messages[queueName], data)
+	return nil
+}
+
+func (p *recordingPublisher) sent(queueName string) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.messages[queueName]
+}
+
+// pipelineOption replaces a dependency of the pipeline built by newTestPipeline.
+type pipelineOption func(p *pipeline)
+
+func withStore(store ProjectStore) pipelineOption {
+	return func(p *pipeline) { p.store = store }
+}
+
+func withPublisher(publisher Publisher) pipelineOption {
+	return func(p *pipeline) { p.publisher = publisher }
+}
+
+func withLedger(ledger Ledger) pipelineOption {
+	return func(p *pipeline) { p.ledger = ledger }
+}
+
+func withStatuses(statuses StatusStore) pipelineOption {
+	return func(p *pipeline) { p.statuses = statuses }
+}
+
+func withProgress(progress *progressBroadcaster) pipelineOption {
+	return func(p *pipeline) { p.progress = progress }
+}
+
+func withCancellations(cancellations *cancelRegistry) pipelineOption {
+	return func(p *pipeline) { p.cancellations = cancellations }
+}
+
+// newTestPipeline returns a pipeline with a MemoryStore and a recordingPublisher, unless opts replace them,
+// downloading under DOWNLOAD_PATH or a temporary directory when it is not set.
+func newTestPipeline(t *testing.T, opts ...pipelineOption) *pipeline {
+	t.Helper()
+	root := os.Getenv("DOWNLOAD_PATH")
+	if root == "" {
+		root = t.TempDir()
+	}
+	p := &pipeline{
+		store:     NewMemoryStore(),
+		fetchers:  defaultFetcherRegistry(WorkspaceLayout{Root: root}, defaultCloneStrategies(), FileLocker{}, defaultStageTimeouts()),
+		publisher: newRecordingPublisher(),
+		timeouts:  defaultStageTimeouts(),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// writeZip creates a zip archive at path containing the given files.
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	w := zip.NewWriter(out)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newFileProjectFixture stores a FILE project and its analysis of branch or commit in store
+// and uploads an archive containing files for it under the download root.
+func newFileProjectFixture(t *testing.T, store *MemoryStore, root string, branch string, commit string, files map[string]string) types_amqp.DispatcherDownloaderMessage {
+	t.Helper()
+	project := codeclarity.Project{Id: uuid.New(), Name: "upload", Type: "FILE"}
+	analysis := codeclarity.Analysis{Id: uuid.New(), OrganizationId: uuid.New(), ProjectId: &project.Id, Branch: branch, Commit: commit}
+	store.AddProject(project)
+	store.AddAnalysis(analysis)
+
+	writeZip(t, filepath.Join(root, uuid.NewString(), project.Id.String(), "upload.zip"), files)
+
+	return types_amqp.DispatcherDownloaderMessage{
+		AnalysisId:     analysis.Id,
+		ProjectId:      project.Id,
+		OrganizationId: analysis.OrganizationId,
+	}
+}
+
+func TestDispatchFileProject(t *testing.T) {
+	var tests = []struct {
+		name   string
+		branch string
+		commit string
+		ref    string
+	}{
+		{"default branch", "", "", "branch-main"},
+		{"branch", "develop", "", "branch-develop"},
+		{"commit", "develop", "4b825dc642cb6eb9a060e54bf8d69288fbee4904", "commit-4b825dc642cb6eb9a060e54bf8d69288fbee4904"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			t.Setenv("DOWNLOAD_PATH", root)
+
+			store := NewMemoryStore()
+			publisher := newRecordingPublisher()
+			message := newFileProjectFixture(t, store, root, tt.branch, tt.commit, map[string]string{
+				"app/package.json":      `{"name": "app"}`,
+				"app/package-lock.json": `{}`,
+			})
+
+			body, _ := json.Marshal(message)
+			action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, newTestPipeline(t, withStore(store), withPublisher(publisher)), true)
+			if action != actionAck {
+				t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+			}
+
+			sent := publisher.sent("downloader_dispatcher")
+			if len(sent) != 1 {
+				t.Fatalf("got %d messages on downloader_dispatcher, want 1 (failures: %s)", len(sent), publisher.sent(failureQueue))
+			}
+			var result DownloadResultMessage
+			if err := json.Unmarshal(sent[0], &result); err != nil {
+				t.Fatal(err)
+			}
+			if result.AnalysisId != message.AnalysisId {
+				t.Errorf("AnalysisId = %s, want %s", result.AnalysisId, message.AnalysisId)
+			}
+			if result.PrimaryLanguage != "javascript" {
+				t.Errorf("PrimaryLanguage = %q, want %q", result.PrimaryLanguage, "javascript")
+			}
+			if !strings.HasPrefix(result.Revision, "sha256:") {
+				t.Errorf("Revision = %q, want a content hash", result.Revision)
+			}
+			want := filepath.Join(root, message.OrganizationId.String(), "projects", message.ProjectId.String(), tt.ref)
+			if result.WorkspacePath != want {
+				t.Errorf("WorkspacePath = %q, want %q", result.WorkspacePath, want)
+			}
+		})
+	}
+}
+
+func TestDispatchGitProject(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+	remote := newFixtureRepo(t, map[string]string{"composer.json": `{}`, "composer.lock": `{}`})
+	head := runTestGit(t, remote, "rev-parse", "HEAD")
+
+	store := NewMemoryStore()
+	project := codeclarity.Project{Id: uuid.New(), Type: "GITHUB", Url: "file://" + remote}
+	integration := codeclarity.Integration{Id: uuid.New(), AccessToken: testToken}
+	analysis := codeclarity.Analysis{Id: uuid.New(), OrganizationId: uuid.New(), ProjectId: &project.Id, Branch: "main"}
+	store.AddProject(project)
+	store.AddIntegration(integration)
+	store.AddAnalysis(analysis)
+
+	publisher := newRecordingPublisher()
+	body, _ := json.Marshal(types_amqp.DispatcherDownloaderMessage{
+		AnalysisId:     analysis.Id,
+		ProjectId:      project.Id,
+		IntegrationId:  integration.Id,
+		OrganizationId: analysis.OrganizationId,
+	})
+	action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, newTestPipeline(t, withStore(store), withPublisher(publisher)), true)
+	if action != actionAck {
+		t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+	}
+
+	sent := publisher.sent("downloader_dispatcher")
+	if len(sent) != 1 {
+		t.Fatalf("got %d messages on downloader_dispatcher, want 1 (failures: %s)", len(sent), publisher.sent(failureQueue))
+	}
+	var result DownloadResultMessage
+	if err := json.Unmarshal(sent[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.PrimaryLanguage != "php" {
+		t.Errorf("PrimaryLanguage = %q, want %q", result.PrimaryLanguage, "php")
+	}
+	if result.Revision != head || result.Commit == nil || result.Commit.SHA != head {
+		t.Errorf("Revision = %q, Commit = %+v, want %s", result.Revision, result.Commit, head)
+	}
+	if result.Commit != nil && (result.Commit.Subject != "initial commit" || result.Commit.CommittedAt.IsZero()) {
+		t.Errorf("Commit = %+v, want the details of the initial commit", result.Commit)
+	}
+
+	if saved := store.DownloadedCommit(analysis.Id); saved.SHA != head || saved.Subject != "initial commit" || saved.CommittedAt.IsZero() {
+		t.Errorf("downloaded commit = %+v, want the details of %s", saved, head)
+	}
+
+	// The requested ref is kept, a redelivered message is downloaded into the same branch workspace
+	saved, _ := store.GetAnalysis(context.Background(), analysis.Id)
+	if saved.Commit != "" {
+		t.Errorf("analysis commit = %q, want the requested commit kept empty", saved.Commit)
+	}
+	if ref, err := workspaceRef(saved); err != nil || ref != branchRef("main") {
+		t.Errorf("workspaceRef() = %q, %v after the download, want %q", ref, err, branchRef("main"))
+	}
+	dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, newTestPipeline(t, withStore(store), withPublisher(publisher)), true)
+	sent = publisher.sent("downloader_dispatcher")
+	var redelivered DownloadResultMessage
+	if len(sent) != 2 || json.Unmarshal(sent[1], &redelivered) != nil || redelivered.WorkspacePath != result.WorkspacePath {
+		t.Errorf("redelivered message downloaded into %q, want %q", redelivered.WorkspacePath, result.WorkspacePath)
+	}
+}
+
+// dispatcherBody returns a valid message of the dispatcher for the download of analysis of project.
+func dispatcherBody(analysis, project uuid.UUID) []byte {
+	body, _ := json.Marshal(types_amqp.DispatcherDownloaderMessage{AnalysisId: analysis, ProjectId: project, OrganizationId: uuid.New()})
+	return body
+}
+
+func TestDispatchFailures(t *testing.T) {
+	var tests = []struct {
+		name   string
+		body   func(store *MemoryStore) []byte
+		action deliveryAction
+		stage  DownloadStage
+		code   FailureCode
+		// deadLetter is set for messages reported on the deadLetterQueue only, having no analysis
+		deadLetter bool
+	}{
+		{
+			name:       "malformed body",
+			body:       func(store *MemoryStore) []byte { return []byte("{not json") },
+			action:     actionReject,
+			stage:      StageDecode,
+			code:       CodeMalformedMessage,
+			deadLetter: true,
+		},
+		{
+			name: "unknown analysis",
+			body: func(store *MemoryStore) []byte {
+				return dispatcherBody(uuid.New(), uuid.New())
+			},
+			action: actionReject,
+			stage:  StageLookup,
+			code:   CodeNotFound,
+		},
+		{
+			name: "missing archive",
+			body: func(store *MemoryStore) []byte {
+				project := codeclarity.Project{Id: uuid.New(), Type: "FILE"}
+				analysis := codeclarity.Analysis{Id: uuid.New(), ProjectId: &project.Id}
+				store.AddProject(project)
+				store.AddAnalysis(analysis)
+				return dispatcherBody(analysis.Id, project.Id)
+			},
+			action: actionAck,
+			stage:  StageExtract,
+			code:   CodeExtractFailed,
+		},
+		{
+			name: "unsupported project type",
+			body: func(store *MemoryStore) []byte {
+				project := codeclarity.Project{Id: uuid.New(), Type: "SVN"}
+				analysis := codeclarity.Analysis{Id: uuid.New(), ProjectId: &project.Id}
+				store.AddProject(project)
+				store.AddAnalysis(analysis)
+				return dispatcherBody(analysis.Id, project.Id)
+			},
+			action: actionAck,
+			stage:  StageLookup,
+			code:   CodeUnsupportedProjectType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DOWNLOAD_PATH", t.TempDir())
+			store := NewMemoryStore()
+			publisher := newRecordingPublisher()
+
+			action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: tt.body(store)}, newTestPipeline(t, withStore(store), withPublisher(publisher)), true)
+			if action != tt.action {
+				t.Errorf("dispatch() = %v, want %v", action, tt.action)
+			}
+			if n := len(publisher.sent("downloader_dispatcher")); n != 0 {
+				t.Errorf("got %d messages on downloader_dispatcher, want 0", n)
+			}
+
+			queue := failureQueue
+			if tt.deadLetter {
+				if n := len(publisher.sent(failureQueue)); n != 0 {
+					t.Errorf("got %d failure messages, want none without an analysis", n)
+				}
+				queue = deadLetterQueue
+			}
+			sent := publisher.sent(queue)
+			if len(sent) != 1 {
+				t.Fatalf("got %d messages on %s, want 1", len(sent), queue)
+			}
+			// Failure messages and dead letters both tell the stage and code
+			var failure struct {
+				Stage DownloadStage `json:"stage"`
+				Code  FailureCode   `json:"code"`
+			}
+			if err := json.Unmarshal(sent[0], &failure); err != nil {
+				t.Fatal(err)
+			}
+			if failure.Stage != tt.stage || failure.Code != tt.code {
+				t.Errorf("failure = %s/%s, want %s/%s", failure.Stage, failure.Code, tt.stage, tt.code)
+			}
+		})
+	}
+}
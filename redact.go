@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// redactedPlaceholder replaces every secret removed from the output.
+const redactedPlaceholder = "[REDACTED]"
+
+// secretPatterns match credentials that must never be logged, even when they are not known secrets.
+// The first group of a pattern, if any, is kept in the redacted text.
+var secretPatterns = []*regexp.Regexp{
+	// GitHub personal, OAuth, user-to-server, server-to-server and refresh tokens
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{20,}\b`),
+	regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{20,}\b`),
+	// GitLab personal, deploy and runner tokens
+	regexp.MustCompile(`\bgl(?:pat|dt|rt)-[A-Za-z0-9_\-]{20,}`),
+	// Authorization headers
+	regexp.MustCompile(`(?i)\b(authorization:\s*(?:bearer|basic|token)\s+)\S+`),
+}
+
+// urlUserinfo matches the credentials part of a URL such as https://token@host/.
+var urlUserinfo = regexp.MustCompile(`://[^/@\s]+@`)
+
+// Redactor scrubs secrets from text.
+// Besides the patterns it always applies, it removes the secrets registered with Add,
+// such as the access tokens of the integrations being used.
+type Redactor struct {
+	mu      sync.RWMutex
+	secrets map[string]int
+}
+
+// defaultRedactor is used for the service logs and the output of subprocesses.
+var defaultRedactor = NewRedactor()
+
+// NewRedactor creates a Redactor without registered secrets
+func NewRedactor() *Redactor {
+	return &Redactor{secrets: make(map[string]int)}
+}
+
+// Add registers secrets to redact until they are removed with Remove.
+// Secrets are reference counted so that concurrent downloads can share them.
+func (r *Redactor) Add(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets[secret]++
+		}
+	}
+}
+
+// Remove unregisters secrets added with Add.
+func (r *Redactor) Remove(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		if r.secrets[secret] <= 1 {
+			delete(r.secrets, secret)
+		} else {
+			r.secrets[secret]--
+		}
+	}
+}
+
+// Redact returns text without the registered secrets, the given extra secrets,
+// URL credentials and anything looking like a token.
+func (r *Redactor) Redact(text string, extra ...string) string {
+	r.mu.RLock()
+	for secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, redactedPlaceholder)
+	}
+	r.mu.RUnlock()
+
+	for _, secret := range extra {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, redactedPlaceholder)
+		}
+	}
+
+	text = urlUserinfo.ReplaceAllString(text, "://"+redactedPlaceholder+"@")
+	for _, pattern := range secretPatterns {
+		text = pattern.ReplaceAllString(text, "${1}"+redactedPlaceholder)
+	}
+	return text
+}
+
+// redact removes the given secrets, the registered ones and any credentials from message.
+func redact(message string, secrets ...string) string {
+	return defaultRedactor.Redact(message, secrets...)
+}
+
+// redactingWriter redacts everything written to it before passing it on.
+// Output is redacted line by line, lines being terminated by '\n' or '\r' as in git progress output,
+// so that a secret split across several writes is still found.
+type redactingWriter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	redactor *Redactor
+	pending  []byte
+}
+
+// newRedactingWriter creates a writer redacting its input with redactor before writing it to out.
+func newRedactingWriter(out io.Writer, redactor *Redactor) *redactingWriter {
+	return &redactingWriter{out: out, redactor: redactor}
+}
+
+// maxPendingLine bounds how much of an unterminated line is buffered before being flushed.
+const maxPendingLine = 64 * 1024
+
+// Write implements io.Writer
+func (w *redactingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexAny(w.pending, "\r\n")
+		if i < 0 {
+			break
+		}
+		if err := w.writeLine(w.pending[:i+1]); err != nil {
+			return len(p), err
+		}
+		w.pending = w.pending[i+1:]
+	}
+	if len(w.pending) > maxPendingLine {
+		if err := w.flush(); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes any unterminated line left in the buffer.
+func (w *redactingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flush()
+}
+
+func (w *redactingWriter) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+	err := w.writeLine(w.pending)
+	w.pending = nil
+	return err
+}
+
+func (w *redactingWriter) writeLine(line []byte) error {
+	_, err := io.WriteString(w.out, w.redactor.Redact(string(line)))
+	return err
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	types_amqp "github.com/CodeClarityCE/utility-types/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// deadLetterQueue holds the invalid messages and those whose download failed for a transient reason
+	// on every attempt, along with the last error, for operators to inspect or replay.
+	deadLetterQueue = "downloader_dead_letter"
+	// attemptHeader counts the attempts made to process a message, the first one has no header.
+	attemptHeader = "x-downloader-attempt"
+
+	// defaultMaxAttempts is the number of attempts made when DOWNLOADER_MAX_ATTEMPTS is not set.
+	defaultMaxAttempts = 5
+	// defaultRetryBaseDelay is the delay before the first retry when DOWNLOADER_RETRY_BASE_DELAY is not set.
+	defaultRetryBaseDelay = 5 * time.Second
+	// defaultRetryMaxDelay caps the delay between retries when DOWNLOADER_RETRY_MAX_DELAY is not set.
+	defaultRetryMaxDelay = 5 * time.Minute
+)
+
+// RetryPolicy tells how messages failing for a transient reason are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts made before the message is dead-lettered
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, it doubles with every attempt
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries
+	MaxDelay time.Duration
+}
+
+// defaultRetryPolicy returns the RetryPolicy used when none is configured.
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: defaultMaxAttempts,
+		BaseDelay:   defaultRetryBaseDelay,
+		MaxDelay:    defaultRetryMaxDelay,
+	}
+}
+
+// loadRetryPolicy reads the RetryPolicy from DOWNLOADER_MAX_ATTEMPTS, DOWNLOADER_RETRY_BASE_DELAY
+// and DOWNLOADER_RETRY_MAX_DELAY. Invalid values are logged and replaced by the defaults.
+func loadRetryPolicy() RetryPolicy {
+	policy := defaultRetryPolicy()
+	policy.MaxAttempts = positiveEnv("DOWNLOADER_MAX_ATTEMPTS", policy.MaxAttempts)
+	policy.BaseDelay = durationEnv("DOWNLOADER_RETRY_BASE_DELAY", policy.BaseDelay)
+	policy.MaxDelay = durationEnv("DOWNLOADER_RETRY_MAX_DELAY", policy.MaxDelay)
+	return policy
+}
+
+// durationEnv returns the positive duration in the environment variable name, or fallback.
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Ignoring %s=%q: not a positive duration", name, value)
+		return fallback
+	}
+	return duration
+}
+
+// delay returns how long to wait before retrying a message whose attempt failed.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// retryable reports whether err may not happen again if the download is retried:
+// the database or the git host could not be reached, a stage timed out or the workspace was busy.
+// Other errors, such as missing records, invalid refs or failed authentications, are permanent.
+func retryable(err error) bool {
+	if errors.Is(err, ErrTransient) || errors.Is(err, ErrTransientRemote) {
+		return true
+	}
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		return downloadErr.Code == CodeTimedOut || downloadErr.Code == CodeWorkspaceLocked
+	}
+	return false
+}
+
+// deliveryAttempt returns the number of the attempt d is processed in, starting at 1.
+func deliveryAttempt(d amqp.Delivery) int {
+	switch attempt := d.Headers[attemptHeader].(type) {
+	case int32:
+		return max(int(attempt), 1)
+	case int64:
+		return max(int(attempt), 1)
+	case int:
+		return max(attempt, 1)
+	default:
+		return 1
+	}
+}
+
+// DeadLetterMessage is sent on the deadLetterQueue when a message is given up on.
+// Publishing Message on Queue replays it.
+type DeadLetterMessage struct {
+	Queue    string          `json:"queue"`
+	Message  json.RawMessage `json:"message"`
+	Attempts int             `json:"attempts"`
+	Stage    DownloadStage   `json:"stage"`
+	Code     FailureCode     `json:"code"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// sendDeadLetter hands the delivery d of queue, which failed with err, over to operators.
+func sendDeadLetter(publisher Publisher, queue string, d amqp.Delivery, err error, secrets ...string) {
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) {
+		downloadErr = newDownloadError(StageLookup, CodeLookupFailed, err)
+	}
+
+	deadLetter := DeadLetterMessage{
+		Queue:    queue,
+		Message:  d.Body,
+		Attempts: deliveryAttempt(d),
+		Stage:    downloadErr.Stage,
+		Code:     downloadErr.Code,
+		Error:    redact(err.Error(), secrets...),
+		FailedAt: time.Now().UTC(),
+	}
+	if !json.Valid(d.Body) {
+		deadLetter.Message, _ = json.Marshal(string(d.Body))
+	}
+	data, _ := json.Marshal(deadLetter)
+	if err := publisher.SendMessage(deadLetterQueue, data); err != nil {
+		log.Printf("Failed to send message to %s: %v", deadLetterQueue, err)
+	}
+}
+
+// giveUp reports the download of apiMessage, which failed with err on its last attempt,
+// to the dispatcher and dead-letters its delivery d.
+func giveUp(publisher Publisher, queue string, d amqp.Delivery, apiMessage types_amqp.DispatcherDownloaderMessage, err error, secrets ...string) {
+	log.Printf("Giving up on analysis %s after %d attempts", apiMessage.AnalysisId, deliveryAttempt(d))
+	sendFailure(publisher, apiMessage, err, secrets...)
+	sendDeadLetter(publisher, queue, d, err, secrets...)
+}
+
+// retryChannel is the part of an AMQP channel used to schedule retries.
+type retryChannel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// delayedRetrier schedules retries through delay queues: messages wait in a queue without consumers
+// until their TTL expires, and are then dead-lettered back to their queue.
+// Waiting messages survive restarts and do not take a worker, or a prefetch slot, while they wait.
+type delayedRetrier struct {
+	mu       sync.Mutex
+	policy   RetryPolicy
+	channel  retryChannel
+	declared map[string]bool
+}
+
+// newDelayedRetrier creates a delayedRetrier, which needs a channel to be attached before it can retry.
+func newDelayedRetrier(policy RetryPolicy) *delayedRetrier {
+	return &delayedRetrier{policy: policy, declared: make(map[string]bool)}
+}
+
+// attach makes the retrier publish on channel, replacing the channel of a lost connection.
+func (r *delayedRetrier) attach(channel retryChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channel = channel
+	r.declared = make(map[string]bool)
+}
+
+// canRetry reports whether d may be retried if its attempt fails.
+func (r *delayedRetrier) canRetry(d amqp.Delivery) bool {
+	return deliveryAttempt(d) < r.policy.MaxAttempts
+}
+
+// delayQueue returns the name of the queue in which messages of queue wait for delay.
+func delayQueue(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%s", queue, delay)
+}
+
+// retry republishes d, whose attempt failed, so that it is delivered again on queue after the backoff.
+// The caller acknowledges d once it is republished.
+func (r *delayedRetrier) retry(queue string, d amqp.Delivery) error {
+	attempt := deliveryAttempt(d)
+	delay := r.policy.delay(attempt)
+	if err := r.publishDelayed(queue, d, delay, attempt+1); err != nil {
+		return err
+	}
+	log.Printf("Retrying message on %s in %s (attempt %d/%d)", queue, delay, attempt+1, r.policy.MaxAttempts)
+	return nil
+}
+
+// postpone republishes d, which was not processed yet, so that it is delivered again on queue after delay.
+// It does not count as an attempt. The caller acknowledges d once it is republished.
+func (r *delayedRetrier) postpone(queue string, d amqp.Delivery, delay time.Duration) error {
+	return r.publishDelayed(queue, d, delay, deliveryAttempt(d))
+}
+
+// publishDelayed publishes d for its attempt on the delay queue of queue expiring after delay.
+func (r *delayedRetrier) publishDelayed(queue string, d amqp.Delivery, delay time.Duration, attempt int) error {
+	name := delayQueue(queue, delay)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.channel == nil {
+		return errors.New("no channel to retry on")
+	}
+	if !r.declared[name] {
+		// The delay is part of the name since the arguments of a queue cannot change
+		_, err := r.channel.QueueDeclare(name, true, false, false, false, amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to declare queue %s: %w", name, err)
+		}
+		r.declared[name] = true
+	}
+
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	headers[attemptHeader] = int32(attempt)
+	err := r.channel.PublishWithContext(context.Background(), "", name, false, false, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         d.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to %s: %w", name, err)
+	}
+	return nil
+}
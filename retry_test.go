@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recordingChannel is a retryChannel keeping the queues declared and the messages published.
+type recordingChannel struct {
+	declared  map[string]amqp.Table
+	published map[string][]amqp.Publishing
+}
+
+func newRecordingChannel() *recordingChannel {
+	return &recordingChannel{declared: make(map[string]amqp.Table), published: make(map[string][]amqp.Publishing)}
+}
+
+func (c *recordingChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.declared[name] = args
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *recordingChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.published[key] = append(c.published[key], msg)
+	return nil
+}
+
+// unreachableStore is a ProjectStore whose database is down.
+type unreachableStore struct {
+	ProjectStore
+}
+
+func (unreachableStore) GetAnalysis(ctx context.Context, analysisID uuid.UUID) (codeclarity.Analysis, error) {
+	return codeclarity.Analysis{}, classifyDBError("analysis", analysisID, sql.ErrConnDone)
+}
+
+func TestLoadRetryPolicy(t *testing.T) {
+	t.Setenv("DOWNLOADER_MAX_ATTEMPTS", "3")
+	t.Setenv("DOWNLOADER_RETRY_BASE_DELAY", "-1s")
+	t.Setenv("DOWNLOADER_RETRY_MAX_DELAY", "1m")
+
+	policy := loadRetryPolicy()
+	want := RetryPolicy{MaxAttempts: 3, BaseDelay: defaultRetryBaseDelay, MaxDelay: time.Minute}
+	if policy != want {
+		t.Errorf("loadRetryPolicy() = %+v, want %+v", policy, want)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: 5 * time.Second, MaxDelay: time.Minute}
+	for attempt, want := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 4: 40 * time.Second, 5: time.Minute, 60: time.Minute} {
+		if delay := policy.delay(attempt); delay != want {
+			t.Errorf("delay(%d) = %v, want %v", attempt, delay, want)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	var tests = []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"database down", classifyDBError("analysis", uuid.New(), sql.ErrConnDone), true},
+		{"not found", classifyDBError("analysis", uuid.New(), sql.ErrNoRows), false},
+		{"timed out", newDownloadError(StageClone, CodeTimedOut, context.DeadlineExceeded), true},
+		{"workspace locked", newDownloadError(StageClone, CodeWorkspaceLocked, ErrWorkspaceLocked), true},
+		{"host unreachable", newDownloadError(StageClone, CodeCloneFailed, classifyGitError(&exec.ExitError{}, "fatal: unable to access 'https://github.com/org/repo.git/': Could not resolve host: github.com")), true},
+		{"server error", newDownloadError(StageClone, CodeCloneFailed, classifyGitError(&exec.ExitError{}, "fatal: unable to access 'https://github.com/org/repo.git/': The requested URL returned error: 502")), true},
+		{"authentication failed", newDownloadError(StageClone, CodeCloneFailed, classifyGitError(&exec.ExitError{}, "fatal: Authentication failed for 'https://github.com/org/repo.git/'")), false},
+		{"invalid ref", newDownloadError(StageClone, CodeInvalidRef, ErrInvalidRef), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.err); got != tt.retryable {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestGitErrorsEndWithGitOutput(t *testing.T) {
+	// Skips the test when git is not installed
+	newFixtureRepo(t, nil)
+
+	git := &gitSession{}
+	err := git.run(t.TempDir(), "clone", "file:///nonexistent/project.git", "project")
+	if err == nil || errors.Is(err, ErrTransientRemote) {
+		t.Fatalf("run() error = %v, want a permanent error", err)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("run() error = %v, want the exit status", err)
+	}
+	if message := err.Error(); len(message) <= len(exitErr.Error()) {
+		t.Errorf("run() error = %q, want the message of git", message)
+	}
+}
+
+func TestDelayedRetrier(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute}
+	retrier := newDelayedRetrier(policy)
+	first := amqp.Delivery{Body: []byte(`{}`), Headers: amqp.Table{"trace": "abc"}}
+	if err := retrier.retry("dispatcher_downloader", first); err == nil {
+		t.Error("retry() without a channel succeeded")
+	}
+
+	channel := newRecordingChannel()
+	retrier.attach(channel)
+	if !retrier.canRetry(first) {
+		t.Error("canRetry() = false on the first attempt")
+	}
+	if err := retrier.retry("dispatcher_downloader", first); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := delayQueue("dispatcher_downloader", time.Second)
+	args, ok := channel.declared[queue]
+	if !ok || args["x-message-ttl"] != int64(1000) || args["x-dead-letter-routing-key"] != "dispatcher_downloader" {
+		t.Errorf("declared %v, want %s expiring to dispatcher_downloader after 1s", channel.declared, queue)
+	}
+	published := channel.published[queue]
+	if len(published) != 1 {
+		t.Fatalf("published %d messages on %s, want 1", len(published), queue)
+	}
+	second := amqp.Delivery{Body: published[0].Body, Headers: published[0].Headers}
+	if deliveryAttempt(second) != 2 || second.Headers["trace"] != "abc" || string(second.Body) != `{}` {
+		t.Errorf("published %+v, want the message for attempt 2", published[0])
+	}
+
+	if err := retrier.retry("dispatcher_downloader", second); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(channel.published[delayQueue("dispatcher_downloader", 2*time.Second)]); n != 1 {
+		t.Errorf("published %d messages after 2s, want 1", n)
+	}
+	if retrier.canRetry(amqp.Delivery{Headers: amqp.Table{attemptHeader: int32(3)}}) {
+		t.Error("canRetry() = true on the last attempt")
+	}
+}
+
+func TestDispatchDeadLettersLastAttempt(t *testing.T) {
+	body := dispatcherBody(uuid.New(), uuid.New())
+	p := newTestPipeline(t, withStore(unreachableStore{}))
+
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionRequeue {
+		t.Errorf("dispatch() = %v, want %v", action, actionRequeue)
+	}
+	publisher := p.publisher.(*recordingPublisher)
+	if n := len(publisher.sent(failureQueue)) + len(publisher.sent(deadLetterQueue)); n != 0 {
+		t.Errorf("got %d messages before the last attempt, want none", n)
+	}
+
+	last := amqp.Delivery{Body: body, Headers: amqp.Table{attemptHeader: int32(5)}}
+	if action := dispatch(context.Background(), "dispatcher_downloader", last, p, false); action != actionAck {
+		t.Errorf("dispatch() = %v, want %v", action, actionAck)
+	}
+	if n := len(publisher.sent(failureQueue)); n != 1 {
+		t.Errorf("got %d failure messages, want 1", n)
+	}
+	sent := publisher.sent(deadLetterQueue)
+	if len(sent) != 1 {
+		t.Fatalf("got %d dead letters, want 1", len(sent))
+	}
+	var deadLetter DeadLetterMessage
+	if err := json.Unmarshal(sent[0], &deadLetter); err != nil {
+		t.Fatal(err)
+	}
+	if deadLetter.Queue != "dispatcher_downloader" || string(deadLetter.Message) != string(body) || deadLetter.Attempts != 5 {
+		t.Errorf("dead letter = %+v, want attempt 5 of the original message", deadLetter)
+	}
+	if deadLetter.Code != CodeLookupFailed || deadLetter.Error == "" {
+		t.Errorf("dead letter = %s %q, want the lookup error", deadLetter.Code, deadLetter.Error)
+	}
+}
+
+func TestDelayedRetrierPostpone(t *testing.T) {
+	retrier := newDelayedRetrier(RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: time.Minute})
+	channel := newRecordingChannel()
+	retrier.attach(channel)
+
+	d := amqp.Delivery{Body: []byte(`{}`), Headers: amqp.Table{attemptHeader: int32(2)}}
+	if err := retrier.postpone("dispatcher_downloader", d, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	published := channel.published[delayQueue("dispatcher_downloader", 2*time.Second)]
+	if len(published) != 1 {
+		t.Fatalf("published %d messages, want 1", len(published))
+	}
+	// Postponing is not an attempt
+	if attempt := deliveryAttempt(amqp.Delivery{Headers: published[0].Headers}); attempt != 2 {
+		t.Errorf("postponed message is on attempt %d, want 2", attempt)
+	}
+}
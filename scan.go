@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+)
+
+// maxScannedEntries bounds the number of entries walked by scanWorkspace,
+// the stats of larger workspaces are partial and come with a warning.
+const maxScannedEntries = 500000
+
+// vendoredDirectories hold the installed dependencies of a project rather than its own sources,
+// the manifests found in them are not reported.
+var vendoredDirectories = []string{"node_modules", "vendor", "bower_components"}
+
+// WorkspaceStats describes the contents of a workspace, so that plugins need not walk it again.
+type WorkspaceStats struct {
+	// Bytes is the total size of the regular files
+	Bytes int64 `json:"total_bytes"`
+	// Files is the number of regular files
+	Files int64 `json:"file_count"`
+	// Manifests lists the dependency manifests and lockfiles by ecosystem, relative to the workspace
+	Manifests map[string][]string `json:"manifests"`
+	// Warnings tells why the workspace or its stats may be incomplete
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// scanWorkspace walks the workspace at root, outside its .git directory, and returns its stats.
+// Symbolic links are not followed and entries that cannot be read are skipped, both with a warning.
+// The walk stops with the error of ctx once it is done.
+func scanWorkspace(ctx context.Context, root string) (WorkspaceStats, error) {
+	stats := WorkspaceStats{Manifests: make(map[string][]string)}
+	manifests := make(map[string]string)
+	for _, ecosystem := range ecosystemManifests {
+		for _, file := range ecosystem.files {
+			manifests[file] = ecosystem.language
+		}
+	}
+
+	var entries, skipped, links int
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if path == root {
+				return err
+			}
+			skipped++
+			return nil
+		}
+		if entries++; entries > maxScannedEntries {
+			stats.Warnings = append(stats.Warnings, fmt.Sprintf("truncated: only the first %d entries were scanned", maxScannedEntries))
+			return fs.SkipAll
+		}
+
+		rel, _ := filepath.Rel(root, path)
+		switch {
+		case entry.IsDir():
+			if entry.Name() == ".git" && path != root {
+				return fs.SkipDir
+			}
+		case entry.Type()&fs.ModeSymlink != 0:
+			links++
+		case entry.Type().IsRegular():
+			info, err := entry.Info()
+			if err != nil {
+				skipped++
+				return nil
+			}
+			stats.Files++
+			stats.Bytes += info.Size()
+			if ecosystem, ok := manifests[entry.Name()]; ok && !vendored(rel) {
+				stats.Manifests[ecosystem] = append(stats.Manifests[ecosystem], filepath.ToSlash(rel))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return WorkspaceStats{}, err
+	}
+
+	if skipped > 0 {
+		stats.Warnings = append(stats.Warnings, fmt.Sprintf("skipped %d entries that could not be read", skipped))
+	}
+	if links > 0 {
+		stats.Warnings = append(stats.Warnings, fmt.Sprintf("skipped %d symbolic links, which were not followed", links))
+	}
+	for _, files := range stats.Manifests {
+		slices.Sort(files)
+	}
+	return stats, nil
+}
+
+// vendored reports whether the relative path rel is within one of the vendoredDirectories.
+func vendored(rel string) bool {
+	for dir := filepath.Dir(rel); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if slices.Contains(vendoredDirectories, filepath.Base(dir)) {
+			return true
+		}
+	}
+	return false
+}
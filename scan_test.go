@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestScanWorkspace(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"package.json":                       `{}`,
+		"yarn.lock":                          "",
+		"web/package.json":                   `{}`,
+		"api/composer.json":                  `{}`,
+		"src/index.js":                       "console.log(1)",
+		"node_modules/left-pad/package.json": `{}`,
+		".git/HEAD":                          "ref: refs/heads/main\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("src/index.js", filepath.Join(root, "main.js")); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := scanWorkspace(context.Background(), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything but the .git directory and the link
+	if stats.Files != 6 || stats.Bytes != 22 {
+		t.Errorf("scanned %d files of %d bytes, want 6 files of 22 bytes", stats.Files, stats.Bytes)
+	}
+	if want := []string{"package.json", "web/package.json", "yarn.lock"}; !slices.Equal(stats.Manifests["javascript"], want) {
+		t.Errorf("javascript manifests = %v, want %v", stats.Manifests["javascript"], want)
+	}
+	if want := []string{"api/composer.json"}; !slices.Equal(stats.Manifests["php"], want) {
+		t.Errorf("php manifests = %v, want %v", stats.Manifests["php"], want)
+	}
+	if len(stats.Warnings) != 1 || !strings.Contains(stats.Warnings[0], "symbolic link") {
+		t.Errorf("warnings = %v, want the skipped link", stats.Warnings)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := scanWorkspace(ctx, root); err == nil {
+		t.Error("scanWorkspace() succeeded with a canceled context")
+	}
+}
+
+func TestDispatchDescribesWorkspace(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+
+	store := NewMemoryStore()
+	message := newFileProjectFixture(t, store, root, "", "", map[string]string{"package.json": `{}`, "lib/composer.json": `{}`, "index.js": ""})
+	body, _ := json.Marshal(message)
+	publisher := newRecordingPublisher()
+	p := newTestPipeline(t, withStore(store), withPublisher(publisher))
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+		t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+	}
+
+	sent := publisher.sent("downloader_dispatcher")
+	if len(sent) != 1 {
+		t.Fatalf("got %d messages on downloader_dispatcher, want 1", len(sent))
+	}
+	var result DownloadResultMessage
+	if err := json.Unmarshal(sent[0], &result); err != nil {
+		t.Fatal(err)
+	}
+	if !filepath.IsAbs(result.WorkspacePath) || result.Source != SourceArchive {
+		t.Errorf("workspace = %s from %s, want an absolute path from an archive", result.WorkspacePath, result.Source)
+	}
+	if result.Files != 3 || result.Bytes != 4 || result.DurationMs < 0 {
+		t.Errorf("stats = %d files of %d bytes in %dms, want 3 files of 4 bytes", result.Files, result.Bytes, result.DurationMs)
+	}
+	if len(result.Manifests["javascript"]) != 1 || len(result.Manifests["php"]) != 1 || result.Manifests["php"][0] != "lib/composer.json" {
+		t.Errorf("manifests = %v, want package.json and lib/composer.json", result.Manifests)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"log"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// statusInterval is the minimum delay between two saves of the progress made within a phase.
+const statusInterval = time.Second
+
+// DownloadPhase is the phase the download of an analysis is in, as shown to users.
+type DownloadPhase string
+
+const (
+	// PhaseQueued means the message of the analysis was received, its records are being looked up
+	PhaseQueued DownloadPhase = "queued"
+	// PhaseCloning means git is receiving the objects of the project
+	PhaseCloning DownloadPhase = "cloning"
+	// PhaseCheckingOut means git is writing the files of the workspace
+	PhaseCheckingOut DownloadPhase = "checking_out"
+	// PhaseExtracting means the uploaded archive is being extracted
+	PhaseExtracting DownloadPhase = "extracting"
+	// PhaseDetecting means the languages of the project are being detected
+	PhaseDetecting DownloadPhase = "detecting"
+	// PhaseRetrying means the download failed for a transient reason and its message waits to be retried
+	PhaseRetrying DownloadPhase = "retrying"
+	// PhaseDone means the project was downloaded and the dispatcher notified
+	PhaseDone DownloadPhase = "done"
+	// PhaseFailed means the download failed for good or was canceled
+	PhaseFailed DownloadPhase = "failed"
+)
+
+// Progress is what the current phase of a download achieved so far.
+type Progress struct {
+	// Percent is the completion of the phase, when known
+	Percent int
+	// Count is the number of objects received while cloning, or of files written otherwise
+	Count int64
+	// Total is the number of objects or files the phase handles, zero if unknown
+	Total int64
+	// Bytes is the number of bytes received while cloning, or extracted from an archive
+	Bytes int64
+}
+
+// ProgressFunc is called with the progress of a download, as it is made.
+// A nil ProgressFunc ignores it.
+type ProgressFunc func(phase DownloadPhase, progress Progress)
+
+// report calls f, if set.
+func (f ProgressFunc) report(phase DownloadPhase, progress Progress) {
+	if f != nil {
+		f(phase, progress)
+	}
+}
+
+// DownloadStatus is the live status of the download of an analysis, shown by the API.
+type DownloadStatus struct {
+	bun.BaseModel `bun:"table:download_status,alias:s"`
+
+	AnalysisId uuid.UUID     `bun:"analysis_id,pk,type:uuid"`
+	Phase      DownloadPhase `bun:"phase,notnull"`
+	Percent    int           `bun:"percent,notnull"`
+	Count      int64         `bun:"count,notnull"`
+	Total      int64         `bun:"total,notnull"`
+	Bytes      int64         `bun:"bytes,notnull"`
+	// Message explains why the download failed, or why it is retried
+	Message        string    `bun:"message,nullzero"`
+	StartedAt      time.Time `bun:"started_at,notnull"`
+	PhaseStartedAt time.Time `bun:"phase_started_at,notnull"`
+	UpdatedAt      time.Time `bun:"updated_at,notnull"`
+	FinishedAt     time.Time `bun:"finished_at,nullzero"`
+}
+
+// StatusStore persists the status of downloads.
+type StatusStore interface {
+	// SaveStatus replaces the status of the download of status.AnalysisId
+	SaveStatus(ctx context.Context, status DownloadStatus) error
+}
+
+// BunStatusStore implements StatusStore on top of the download_status table,
+// which is created by a migration of the API, see migrations/0002_download_status.sql.
+type BunStatusStore struct {
+	// db returns the current connection, which ServiceBase replaces when it reconnects
+	db func() *bun.DB
+}
+
+// NewBunStatusStore creates a BunStatusStore writing to the database returned by db.
+func NewBunStatusStore(db func() *bun.DB) *BunStatusStore {
+	return &BunStatusStore{db: db}
+}
+
+// SaveStatus implements StatusStore
+func (s *BunStatusStore) SaveStatus(ctx context.Context, status DownloadStatus) error {
+	_, err := s.db().NewInsert().
+		Model(&status).
+		On("CONFLICT (analysis_id) DO UPDATE").
+		Returning("NULL").
+		Exec(ctx)
+	if err != nil {
+		return classifyDBError("download status", status.AnalysisId, err)
+	}
+	return nil
+}
+
+// MemoryStatusStore is an in-memory StatusStore keeping every status saved, used to run the pipeline without a database.
+type MemoryStatusStore struct {
+	mu       sync.Mutex
+	statuses map[uuid.UUID][]DownloadStatus
+}
+
+// NewMemoryStatusStore creates an empty MemoryStatusStore
+func NewMemoryStatusStore() *MemoryStatusStore {
+	return &MemoryStatusStore{statuses: make(map[uuid.UUID][]DownloadStatus)}
+}
+
+// SaveStatus implements StatusStore
+func (s *MemoryStatusStore) SaveStatus(ctx context.Context, status DownloadStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[status.AnalysisId] = append(s.statuses[status.AnalysisId], status)
+	return nil
+}
+
+// History returns the statuses saved for the download of analysis, oldest first.
+func (s *MemoryStatusStore) History(analysis uuid.UUID) []DownloadStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]DownloadStatus(nil), s.statuses[analysis]...)
+}
+
+// statusReporter saves the status of the download of an analysis as it progresses.
+// Phase changes are saved at once, the progress within a phase at most every statusInterval.
+// A nil statusReporter does not save anything.
+type statusReporter struct {
+	mu      sync.Mutex
+	store   StatusStore
+	timeout time.Duration
+	status  DownloadStatus
+	saved   time.Time
+}
+
+// newStatusReporter creates a statusReporter saving to store, each save bounded by timeout.
+// It returns nil if store is nil.
+func newStatusReporter(store StatusStore, analysis uuid.UUID, timeout time.Duration) *statusReporter {
+	if store == nil {
+		return nil
+	}
+	return &statusReporter{store: store, timeout: timeout, status: DownloadStatus{AnalysisId: analysis}}
+}
+
+// report records that the download is in phase and made progress in it. It implements ProgressFunc.
+func (r *statusReporter) report(phase DownloadPhase, progress Progress) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	changed := phase != r.status.Phase
+	if !changed && now.Sub(r.saved) < statusInterval {
+		return
+	}
+	if r.status.StartedAt.IsZero() {
+		r.status.StartedAt = now
+	}
+	if changed {
+		r.status.PhaseStartedAt = now
+	}
+	r.status.Phase = phase
+	r.status.Percent = progress.Percent
+	r.status.Count = progress.Count
+	r.status.Total = progress.Total
+	r.status.Bytes = progress.Bytes
+	r.save(now)
+}
+
+// finish records that the download completed, or failed with err, whose message is stripped of secrets.
+func (r *statusReporter) finish(err error, secrets ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.status.StartedAt.IsZero() {
+		r.status.StartedAt = now
+	}
+	r.status.PhaseStartedAt = now
+	r.status.FinishedAt = now
+	r.status.Phase = PhaseDone
+	if err != nil {
+		r.status.Phase = PhaseFailed
+		r.status.Message = redact(err.Error(), secrets...)
+	} else {
+		r.status.Percent = 100
+	}
+	r.save(now)
+}
+
+// retry records that the download failed with err, whose message is stripped of secrets,
+// and will be retried. The download is not finished, its next attempt reports its phases from PhaseQueued again.
+func (r *statusReporter) retry(err error, secrets ...string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.status.StartedAt.IsZero() {
+		r.status.StartedAt = now
+	}
+	r.status.PhaseStartedAt = now
+	r.status.Phase = PhaseRetrying
+	r.status.Message = redact(err.Error(), secrets...)
+	r.save(now)
+}
+
+// save writes the status, failures are only logged since the download does not depend on it.
+func (r *statusReporter) save(now time.Time) {
+	r.status.UpdatedAt = now
+	r.saved = now
+	ctx, cancel := withStageTimeout(context.Background(), r.timeout)
+	defer cancel()
+	if err := r.store.SaveStatus(ctx, r.status); err != nil {
+		log.Printf("Failed to save the status of analysis %s: %v", r.status.AnalysisId, err)
+	}
+}
+
+// gitProgressLine matches the progress git prints with --progress, such as
+// "Receiving objects:  45% (450/1000), 1.20 MiB | 1.00 MiB/s".
+var gitProgressLine = regexp.MustCompile(`^(?:remote: )?([A-Za-z ]+):\s+(\d+)% \((\d+)/(\d+)\)(?:, ([\d.]+) (bytes|KiB|MiB|GiB))?`)
+
+// gitProgressUnits are the sizes of the units git reports the bytes it received in.
+var gitProgressUnits = map[string]float64{"bytes": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30}
+
+// gitProgressWriter parses the output of git commands and reports their progress.
+// It is not safe for concurrent use, like the output of a git command.
+type gitProgressWriter struct {
+	progress ProgressFunc
+	line     []byte
+	// received is the number of bytes received so far, kept while deltas are resolved
+	received int64
+}
+
+// newGitProgressWriter creates a gitProgressWriter reporting to progress.
+func newGitProgressWriter(progress ProgressFunc) *gitProgressWriter {
+	return &gitProgressWriter{progress: progress}
+}
+
+// Write implements io.Writer, progress lines are terminated by '\r' and other lines by '\n'.
+func (w *gitProgressWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '\r' && b != '\n' {
+			w.line = append(w.line, b)
+			continue
+		}
+		w.parse(string(w.line))
+		w.line = w.line[:0]
+	}
+	return len(p), nil
+}
+
+// parse reports the progress in line, if it is a progress line of a known phase.
+func (w *gitProgressWriter) parse(line string) {
+	match := gitProgressLine.FindStringSubmatch(line)
+	if match == nil {
+		return
+	}
+	var phase DownloadPhase
+	switch match[1] {
+	case "Receiving objects", "Resolving deltas":
+		phase = PhaseCloning
+	case "Updating files", "Checking out files":
+		phase = PhaseCheckingOut
+	default:
+		// Counting and compressing happen on the remote before anything is received
+		return
+	}
+
+	percent, _ := strconv.Atoi(match[2])
+	count, _ := strconv.ParseInt(match[3], 10, 64)
+	total, _ := strconv.ParseInt(match[4], 10, 64)
+	if match[5] != "" {
+		size, _ := strconv.ParseFloat(match[5], 64)
+		w.received = int64(size * gitProgressUnits[match[6]])
+	}
+	progress := Progress{Percent: percent, Count: count, Total: total}
+	if phase == PhaseCloning {
+		progress.Bytes = w.received
+	}
+	w.progress.report(phase, progress)
+}
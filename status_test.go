@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// progressRecorder is a ProgressFunc keeping every progress reported.
+type progressRecorder struct {
+	phases   []DownloadPhase
+	progress []Progress
+}
+
+func (r *progressRecorder) report(phase DownloadPhase, progress Progress) {
+	r.phases = append(r.phases, phase)
+	r.progress = append(r.progress, progress)
+}
+
+// last returns the last progress reported in phase.
+func (r *progressRecorder) last(phase DownloadPhase) (Progress, bool) {
+	for i := len(r.phases) - 1; i >= 0; i-- {
+		if r.phases[i] == phase {
+			return r.progress[i], true
+		}
+	}
+	return Progress{}, false
+}
+
+func TestGitProgressWriter(t *testing.T) {
+	recorder := &progressRecorder{}
+	w := newGitProgressWriter(recorder.report)
+	output := "Cloning into 'project'...\n" +
+		"remote: Counting objects: 100% (12/12), done.\n" +
+		"Receiving objects:  50% (6/12)\rReceiving objects:  83% (10/12), 1.50 MiB | 3.00 MiB/s\r" +
+		"Receiving objects: 100% (12/12), 2.00 MiB | 3.00 MiB/s, done.\n" +
+		"Resolving deltas: 100% (4/4), done.\n" +
+		"Updating files:  40% (2/5)\rUpdating fi"
+	// Lines may be split across writes
+	w.Write([]byte(output))
+	w.Write([]byte("les: 100% (5/5), done.\n"))
+
+	want := []DownloadPhase{PhaseCloning, PhaseCloning, PhaseCloning, PhaseCloning, PhaseCheckingOut, PhaseCheckingOut}
+	if len(recorder.phases) != len(want) {
+		t.Fatalf("reported %v, want %v", recorder.phases, want)
+	}
+	if progress := recorder.progress[1]; progress != (Progress{Percent: 83, Count: 10, Total: 12, Bytes: 3 << 19}) {
+		t.Errorf("receiving progress = %+v, want 10/12 objects and 1.5 MiB", progress)
+	}
+	if progress := recorder.progress[3]; progress.Bytes != 2<<20 || progress.Count != 4 {
+		t.Errorf("resolving progress = %+v, want 4 deltas and the 2 MiB received", progress)
+	}
+	if progress, _ := recorder.last(PhaseCheckingOut); progress != (Progress{Percent: 100, Count: 5, Total: 5}) {
+		t.Errorf("checkout progress = %+v, want 5/5 files", progress)
+	}
+}
+
+func TestGitReportsProgress(t *testing.T) {
+	remote := newFixtureRepo(t, map[string]string{"package.json": `{}`, "src/index.js": "", "README.md": ""})
+
+	recorder := &progressRecorder{}
+	analysis := codeclarity.Analysis{Branch: "main"}
+	project := codeclarity.Project{Url: "file://" + remote}
+	_, err := Git(context.Background(), analysis, project, codeclarity.Integration{}, filepath.Join(t.TempDir(), "main"), GitOptions{Progress: recorder.report})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress, ok := recorder.last(PhaseCloning); !ok || progress.Total == 0 || progress.Count != progress.Total {
+		t.Errorf("cloning progress = %+v, want every object received", progress)
+	}
+	if progress, ok := recorder.last(PhaseCheckingOut); ok && progress.Count != 3 {
+		t.Errorf("checkout progress = %+v, want 3 files", progress)
+	}
+}
+
+func TestStatusReporter(t *testing.T) {
+	store := NewMemoryStatusStore()
+	analysis := uuid.New()
+	status := newStatusReporter(store, analysis, defaultStageTimeouts().Lookup)
+
+	status.report(PhaseCloning, Progress{Percent: 10})
+	// Progress within a phase is throttled, phase changes are not
+	status.report(PhaseCloning, Progress{Percent: 20})
+	status.report(PhaseCheckingOut, Progress{Percent: 0})
+	status.finish(errors.New("failed with secret-token"), "secret-token")
+
+	history := store.History(analysis)
+	if len(history) != 3 {
+		t.Fatalf("saved %d statuses, want 3", len(history))
+	}
+	if history[0].Phase != PhaseCloning || history[0].Percent != 10 || history[1].Phase != PhaseCheckingOut {
+		t.Errorf("saved %+v, want cloning at 10%% then checking out", history[:2])
+	}
+	final := history[2]
+	if final.Phase != PhaseFailed || final.FinishedAt.IsZero() || final.Message != "failed with "+redactedPlaceholder {
+		t.Errorf("final status = %+v, want a redacted failure", final)
+	}
+	if !final.StartedAt.Equal(history[0].StartedAt) || final.PhaseStartedAt.Before(history[1].PhaseStartedAt) {
+		t.Errorf("final status = %+v, want the start of the download kept", final)
+	}
+
+	var none *statusReporter
+	none.report(PhaseCloning, Progress{})
+	none.finish(nil)
+}
+
+func TestDispatchRecordsStatus(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("DOWNLOAD_PATH", root)
+
+	store := NewMemoryStore()
+	message := newFileProjectFixture(t, store, root, "", "", map[string]string{"package.json": `{}`, "index.js": "", "lib/util.js": ""})
+	body, _ := json.Marshal(message)
+	statuses := NewMemoryStatusStore()
+	p := newTestPipeline(t, withStore(store), withStatuses(statuses))
+	if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: body}, p, true); action != actionAck {
+		t.Fatalf("dispatch() = %v, want %v", action, actionAck)
+	}
+
+	var phases []DownloadPhase
+	for _, status := range statuses.History(message.AnalysisId) {
+		phases = append(phases, status.Phase)
+	}
+	want := []DownloadPhase{PhaseQueued, PhaseExtracting, PhaseDetecting, PhaseDone}
+	if len(phases) != len(want) {
+		t.Fatalf("saved phases %v, want %v", phases, want)
+	}
+	for i := range want {
+		if phases[i] != want[i] {
+			t.Fatalf("saved phases %v, want %v", phases, want)
+		}
+	}
+}
+
+func TestDispatchRecordsRetries(t *testing.T) {
+	var tests = []struct {
+		name     string
+		canRetry bool
+		action   deliveryAction
+		phase    DownloadPhase
+		finished bool
+	}{
+		{"retried", true, actionRequeue, PhaseRetrying, false},
+		{"last attempt", false, actionAck, PhaseFailed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis := uuid.New()
+			statuses := NewMemoryStatusStore()
+			p := newTestPipeline(t, withStore(unreachableStore{}), withStatuses(statuses))
+			if action := dispatch(context.Background(), "dispatcher_downloader", amqp.Delivery{Body: dispatcherBody(analysis, uuid.New())}, p, tt.canRetry); action != tt.action {
+				t.Fatalf("dispatch() = %v, want %v", action, tt.action)
+			}
+
+			history := statuses.History(analysis)
+			if len(history) == 0 {
+				t.Fatal("no status saved")
+			}
+			final := history[len(history)-1]
+			if final.Phase != tt.phase || final.FinishedAt.IsZero() == tt.finished || final.Message == "" {
+				t.Errorf("final status = %+v, want %s with its reason", final, tt.phase)
+			}
+			for _, status := range history {
+				if tt.canRetry && status.Phase == PhaseFailed {
+					t.Errorf("saved %+v for a download that is retried", status)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractReportsProgress(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "project.zip")
+	writeZip(t, archive, map[string]string{"package.json": `{}`, "index.js": "console.log(1)"})
+
+	recorder := &progressRecorder{}
+	if err := extractZip(context.Background(), archive, t.TempDir(), recorder.report); err != nil {
+		t.Fatal(err)
+	}
+	if progress, _ := recorder.last(PhaseExtracting); progress != (Progress{Percent: 100, Count: 2, Total: 2, Bytes: 16}) {
+		t.Errorf("extraction progress = %+v, want 2 files and 16 bytes", progress)
+	}
+}
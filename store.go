@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+// ProjectStore gives access to the records needed to download the project of an analysis.
+// Implementations return errors wrapping ErrNotFound or ErrTransient where applicable.
+type ProjectStore interface {
+	GetAnalysis(ctx context.Context, analysisID uuid.UUID) (codeclarity.Analysis, error)
+	GetProject(ctx context.Context, projectID uuid.UUID) (codeclarity.Project, error)
+	GetIntegration(ctx context.Context, integrationID uuid.UUID) (codeclarity.Integration, error)
+	// SaveCommit records the commit that was downloaded for the analysis.
+	// The commit the analysis requested is left untouched.
+	SaveCommit(ctx context.Context, analysisID uuid.UUID, commit CommitInfo) error
+}
+
+// Publisher sends messages on AMQP queues. It is implemented by boilerplates.ServiceBase.
+type Publisher interface {
+	SendMessage(queueName string, data []byte) error
+}
+
+// syncPublisher serializes the messages sent by concurrent workers,
+// as ServiceBase is not safe for concurrent use.
+type syncPublisher struct {
+	mu        sync.Mutex
+	publisher Publisher
+}
+
+// SendMessage implements Publisher
+func (p *syncPublisher) SendMessage(queueName string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.publisher.SendMessage(queueName, data)
+}
+
+// BunStore implements ProjectStore on top of the CodeClarity database.
+type BunStore struct {
+	// db returns the current connection, which ServiceBase replaces when it reconnects
+	db func() *bun.DB
+}
+
+// NewBunStore creates a BunStore reading from the database returned by db.
+func NewBunStore(db func() *bun.DB) *BunStore {
+	return &BunStore{db: db}
+}
+
+// GetAnalysis implements ProjectStore
+func (s *BunStore) GetAnalysis(ctx context.Context, analysisID uuid.UUID) (codeclarity.Analysis, error) {
+	return getAnalysis(ctx, s.db(), analysisID)
+}
+
+// GetProject implements ProjectStore
+func (s *BunStore) GetProject(ctx context.Context, projectID uuid.UUID) (codeclarity.Project, error) {
+	return getProject(ctx, s.db(), projectID)
+}
+
+// GetIntegration implements ProjectStore
+func (s *BunStore) GetIntegration(ctx context.Context, integrationID uuid.UUID) (codeclarity.Integration, error) {
+	return getIntegration(ctx, s.db(), integrationID)
+}
+
+// SaveCommit implements ProjectStore
+func (s *BunStore) SaveCommit(ctx context.Context, analysisID uuid.UUID, commit CommitInfo) error {
+	return saveDownloadedCommit(ctx, s.db(), analysisID, commit)
+}
+
+// MemoryStore is an in-memory ProjectStore, used to run the pipeline without a database.
+type MemoryStore struct {
+	mu           sync.RWMutex
+	analyses     map[uuid.UUID]codeclarity.Analysis
+	projects     map[uuid.UUID]codeclarity.Project
+	integrations map[uuid.UUID]codeclarity.Integration
+	commits      map[uuid.UUID]CommitInfo
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		analyses:     make(map[uuid.UUID]codeclarity.Analysis),
+		projects:     make(map[uuid.UUID]codeclarity.Project),
+		integrations: make(map[uuid.UUID]codeclarity.Integration),
+		commits:      make(map[uuid.UUID]CommitInfo),
+	}
+}
+
+// AddAnalysis stores an analysis
+func (s *MemoryStore) AddAnalysis(analysis codeclarity.Analysis) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.analyses[analysis.Id] = analysis
+}
+
+// AddProject stores a project
+func (s *MemoryStore) AddProject(project codeclarity.Project) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.projects[project.Id] = project
+}
+
+// AddIntegration stores an integration
+func (s *MemoryStore) AddIntegration(integration codeclarity.Integration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.integrations[integration.Id] = integration
+}
+
+// GetAnalysis implements ProjectStore
+func (s *MemoryStore) GetAnalysis(ctx context.Context, analysisID uuid.UUID) (codeclarity.Analysis, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	analysis, ok := s.analyses[analysisID]
+	if !ok {
+		return codeclarity.Analysis{}, classifyDBError("analysis", analysisID, sql.ErrNoRows)
+	}
+	return analysis, nil
+}
+
+// GetProject implements ProjectStore
+func (s *MemoryStore) GetProject(ctx context.Context, projectID uuid.UUID) (codeclarity.Project, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	project, ok := s.projects[projectID]
+	if !ok {
+		return codeclarity.Project{}, classifyDBError("project", projectID, sql.ErrNoRows)
+	}
+	return project, nil
+}
+
+// GetIntegration implements ProjectStore
+func (s *MemoryStore) GetIntegration(ctx context.Context, integrationID uuid.UUID) (codeclarity.Integration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	integration, ok := s.integrations[integrationID]
+	if !ok {
+		return codeclarity.Integration{}, classifyDBError("integration", integrationID, sql.ErrNoRows)
+	}
+	return integration, nil
+}
+
+// SaveCommit implements ProjectStore
+func (s *MemoryStore) SaveCommit(ctx context.Context, analysisID uuid.UUID, commit CommitInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.analyses[analysisID]; !ok {
+		return classifyDBError("analysis", analysisID, sql.ErrNoRows)
+	}
+	s.commits[analysisID] = commit
+	return nil
+}
+
+// DownloadedCommit returns the commit saved for an analysis by SaveCommit
+func (s *MemoryStore) DownloadedCommit(analysisID uuid.UUID) CommitInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.commits[analysisID]
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+// CloneStrategy controls how much of the history and content of a repository is downloaded.
+type CloneStrategy string
+
+const (
+	// CloneFull downloads the entire history
+	CloneFull CloneStrategy = "full"
+	// CloneShallow downloads only the requested commit, deepening the history when it is not found
+	CloneShallow CloneStrategy = "shallow"
+	// ClonePartial downloads the entire history but only the file contents of the checked out commit
+	ClonePartial CloneStrategy = "partial"
+	// CloneManifests is a partial clone checking out only the dependency manifests and lockfiles
+	// listed in ecosystemManifests, for analyses that do not read the sources
+	CloneManifests CloneStrategy = "manifests"
+	// CloneMirror keeps the entire history in a bare mirror shared by the analyses of a project,
+	// each analysis getting a worktree of it
+	CloneMirror CloneStrategy = "mirror"
+)
+
+// analysisCloneStrategyKey is the key of the analysis configuration overriding the clone strategy.
+const analysisCloneStrategyKey = "clone_strategy"
+
+// parseCloneStrategy validates a clone strategy read from the configuration.
+func parseCloneStrategy(value string) (CloneStrategy, error) {
+	strategy := CloneStrategy(strings.ToLower(strings.TrimSpace(value)))
+	switch strategy {
+	case CloneFull, CloneShallow, ClonePartial, CloneManifests, CloneMirror:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown clone strategy %q", value)
+}
+
+// fetchArgs returns the arguments limiting what git clone and git fetch download.
+func (s CloneStrategy) fetchArgs() []string {
+	switch s {
+	case CloneShallow:
+		return []string{"--depth", "1"}
+	case ClonePartial, CloneManifests:
+		return []string{"--filter=blob:none"}
+	}
+	return nil
+}
+
+// sparsePatterns returns the sparse checkout patterns of the strategy, nil when every file is checked out.
+// The patterns have no slash so that they match manifests at any depth.
+func (s CloneStrategy) sparsePatterns() []string {
+	if s != CloneManifests {
+		return nil
+	}
+	var patterns []string
+	for _, ecosystem := range ecosystemManifests {
+		patterns = append(patterns, ecosystem.files...)
+	}
+	return patterns
+}
+
+// CloneStrategies chooses the clone strategy of an analysis.
+// The strategy set in the analysis configuration takes precedence over the one of its organization,
+// which takes precedence over the default of its project type.
+type CloneStrategies struct {
+	ByProjectType  map[string]CloneStrategy
+	ByOrganization map[uuid.UUID]CloneStrategy
+	Default        CloneStrategy
+}
+
+// defaultCloneStrategies only downloads the commit being analyzed for the git forges.
+func defaultCloneStrategies() CloneStrategies {
+	return CloneStrategies{
+		ByProjectType: map[string]CloneStrategy{
+			"GITHUB": CloneShallow,
+			"GITLAB": CloneShallow,
+		},
+		ByOrganization: make(map[uuid.UUID]CloneStrategy),
+		Default:        CloneFull,
+	}
+}
+
+// loadCloneStrategies reads the clone strategies from the environment:
+//   - DOWNLOADER_CLONE_STRATEGY_<PROJECT TYPE> overrides the default of a project type, e.g. DOWNLOADER_CLONE_STRATEGY_GITLAB=partial
+//   - DOWNLOADER_ORGANIZATION_CLONE_STRATEGIES sets the strategy of organizations, e.g. "<organization id>=full,<organization id>=partial"
+//
+// Invalid values are logged and ignored.
+func loadCloneStrategies() CloneStrategies {
+	strategies := defaultCloneStrategies()
+
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		projectType, ok := strings.CutPrefix(name, "DOWNLOADER_CLONE_STRATEGY_")
+		if !ok {
+			continue
+		}
+		strategy, err := parseCloneStrategy(value)
+		if err != nil {
+			log.Printf("Ignoring %s: %v", name, err)
+			continue
+		}
+		strategies.ByProjectType[strings.ToUpper(projectType)] = strategy
+	}
+
+	for _, entry := range strings.Split(os.Getenv("DOWNLOADER_ORGANIZATION_CLONE_STRATEGIES"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		id, value, _ := strings.Cut(entry, "=")
+		organization, err := uuid.Parse(strings.TrimSpace(id))
+		if err != nil {
+			log.Printf("Ignoring clone strategy of organization %q: %v", id, err)
+			continue
+		}
+		strategy, err := parseCloneStrategy(value)
+		if err != nil {
+			log.Printf("Ignoring clone strategy of organization %s: %v", organization, err)
+			continue
+		}
+		strategies.ByOrganization[organization] = strategy
+	}
+
+	return strategies
+}
+
+// Resolve returns the clone strategy to download the project of analysis with.
+func (c CloneStrategies) Resolve(analysis codeclarity.Analysis, project codeclarity.Project, organization uuid.UUID) CloneStrategy {
+	if value, ok := analysis.Config[analysisCloneStrategyKey].(string); ok {
+		strategy, err := parseCloneStrategy(value)
+		if err == nil {
+			return strategy
+		}
+		log.Printf("Ignoring clone strategy of analysis %s: %v", analysis.Id, err)
+	}
+	if strategy, ok := c.ByOrganization[organization]; ok {
+		return strategy
+	}
+	if strategy, ok := c.ByProjectType[strings.ToUpper(project.Type)]; ok {
+		return strategy
+	}
+	if c.Default != "" {
+		return c.Default
+	}
+	return CloneFull
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+func TestResolveCloneStrategy(t *testing.T) {
+	organization := uuid.New()
+	strategies := defaultCloneStrategies()
+	strategies.ByOrganization[organization] = ClonePartial
+
+	var tests = []struct {
+		name         string
+		config       map[string]any
+		projectType  string
+		organization uuid.UUID
+		want         CloneStrategy
+	}{
+		{"project type", nil, "GITHUB", uuid.New(), CloneShallow},
+		{"default", nil, "FILE", uuid.New(), CloneFull},
+		{"organization", nil, "GITHUB", organization, ClonePartial},
+		{"analysis", map[string]any{"clone_strategy": "full"}, "GITHUB", organization, CloneFull},
+		{"manifests", map[string]any{"clone_strategy": "manifests"}, "GITLAB", uuid.New(), CloneManifests},
+		{"invalid analysis", map[string]any{"clone_strategy": "sparse"}, "GITLAB", uuid.New(), CloneShallow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			analysis := codeclarity.Analysis{Id: uuid.New(), Config: tt.config}
+			project := codeclarity.Project{Type: tt.projectType}
+			if got := strategies.Resolve(analysis, project, tt.organization); got != tt.want {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadCloneStrategies(t *testing.T) {
+	organization := uuid.New()
+	t.Setenv("DOWNLOADER_CLONE_STRATEGY_GITLAB", "partial")
+	t.Setenv("DOWNLOADER_ORGANIZATION_CLONE_STRATEGIES", organization.String()+"=full, not-a-uuid=shallow")
+
+	strategies := loadCloneStrategies()
+	if got := strategies.ByProjectType["GITLAB"]; got != ClonePartial {
+		t.Errorf("GITLAB strategy = %q, want %q", got, ClonePartial)
+	}
+	if got := strategies.ByProjectType["GITHUB"]; got != CloneShallow {
+		t.Errorf("GITHUB strategy = %q, want %q", got, CloneShallow)
+	}
+	if got := strategies.ByOrganization[organization]; got != CloneFull {
+		t.Errorf("organization strategy = %q, want %q", got, CloneFull)
+	}
+	if len(strategies.ByOrganization) != 1 {
+		t.Errorf("ByOrganization = %v, want a single organization", strategies.ByOrganization)
+	}
+}
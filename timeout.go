@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	// defaultCloneTimeout bounds the download of a git project when DOWNLOADER_CLONE_TIMEOUT is not set.
+	defaultCloneTimeout = 30 * time.Minute
+	// defaultExtractTimeout bounds the extraction of an archive when DOWNLOADER_EXTRACT_TIMEOUT is not set.
+	defaultExtractTimeout = 10 * time.Minute
+)
+
+// StageTimeouts bounds the time spent in each stage of a download.
+// A zero timeout does not bound its stage.
+type StageTimeouts struct {
+	// Lookup bounds each database lookup
+	Lookup time.Duration
+	// Clone bounds the discovery of the default branch and the download of a git project
+	Clone time.Duration
+	// Extract bounds the extraction of an uploaded archive
+	Extract time.Duration
+}
+
+// defaultStageTimeouts returns the timeouts used when none are configured.
+func defaultStageTimeouts() StageTimeouts {
+	return StageTimeouts{
+		Lookup:  lookupTimeout,
+		Clone:   defaultCloneTimeout,
+		Extract: defaultExtractTimeout,
+	}
+}
+
+// loadStageTimeouts reads the StageTimeouts from DOWNLOADER_LOOKUP_TIMEOUT, DOWNLOADER_CLONE_TIMEOUT
+// and DOWNLOADER_EXTRACT_TIMEOUT, which are durations such as "90s" or "1h".
+// Invalid values are logged and replaced by the defaults.
+func loadStageTimeouts() StageTimeouts {
+	timeouts := defaultStageTimeouts()
+	for name, timeout := range map[string]*time.Duration{
+		"DOWNLOADER_LOOKUP_TIMEOUT":  &timeouts.Lookup,
+		"DOWNLOADER_CLONE_TIMEOUT":   &timeouts.Clone,
+		"DOWNLOADER_EXTRACT_TIMEOUT": &timeouts.Extract,
+	} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration < 0 {
+			log.Printf("Ignoring %s=%q: not a valid duration", name, value)
+			continue
+		}
+		*timeout = duration
+	}
+	return timeouts
+}
+
+// withStageTimeout returns a context of ctx bounded by timeout, unless timeout is zero.
+func withStageTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// timedOut reports err with CodeTimedOut if ctx, the context of the stage that returned it, expired.
+// The stage of err is kept, errors that are not a DownloadError are attributed to stage.
+func timedOut(ctx context.Context, stage DownloadStage, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		stage = downloadErr.Stage
+		err = downloadErr.Err
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		// Commands killed by the context only report their exit status
+		err = fmt.Errorf("%w: %w", context.DeadlineExceeded, err)
+	}
+	return newDownloadError(stage, CodeTimedOut, err)
+}
+
+// contextReader is an io.Reader failing with the error of its context once it is done,
+// so that long copies can be interrupted.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// Read implements io.Reader
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
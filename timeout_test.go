@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+func TestLoadStageTimeouts(t *testing.T) {
+	t.Setenv("DOWNLOADER_CLONE_TIMEOUT", "90s")
+	t.Setenv("DOWNLOADER_EXTRACT_TIMEOUT", "soon")
+
+	timeouts := loadStageTimeouts()
+	want := StageTimeouts{Lookup: lookupTimeout, Clone: 90 * time.Second, Extract: defaultExtractTimeout}
+	if timeouts != want {
+		t.Errorf("loadStageTimeouts() = %+v, want %+v", timeouts, want)
+	}
+}
+
+func TestTimedOutKeepsStage(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	cloneErr := newDownloadError(StageCheckout, CodeCheckoutFailed, errors.New("signal: killed"))
+
+	var downloadErr *DownloadError
+	if err := timedOut(expired, StageClone, cloneErr); !errors.As(err, &downloadErr) ||
+		downloadErr.Stage != StageCheckout || downloadErr.Code != CodeTimedOut || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timedOut() = %v, want a %s %s error", err, StageCheckout, CodeTimedOut)
+	}
+	if err := timedOut(context.Background(), StageClone, cloneErr); err != cloneErr {
+		t.Errorf("timedOut() = %v, want the error unchanged", err)
+	}
+}
+
+func TestGitFetcherTimesOut(t *testing.T) {
+	// Skips the test when git is not installed
+	newFixtureRepo(t, nil)
+
+	// A git daemon that accepts connections but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	fetcher := gitFetcher{layout: WorkspaceLayout{Root: t.TempDir()}, strategies: defaultCloneStrategies(), timeout: 500 * time.Millisecond}
+	for _, branch := range []string{"", "main"} {
+		request := FetchRequest{
+			Analysis:     codeclarity.Analysis{Id: uuid.New(), Branch: branch},
+			Project:      codeclarity.Project{Id: uuid.New(), Type: "GITHUB", Url: "git://" + listener.Addr().String() + "/project.git"},
+			Organization: uuid.New(),
+		}
+
+		start := time.Now()
+		_, err := fetcher.Fetch(context.Background(), request)
+		var downloadErr *DownloadError
+		if !errors.As(err, &downloadErr) || downloadErr.Code != CodeTimedOut {
+			t.Errorf("Fetch(branch %q) error = %v, want %s", branch, err, CodeTimedOut)
+		}
+		if elapsed := time.Since(start); elapsed > gitWaitDelay+5*time.Second {
+			t.Errorf("Fetch(branch %q) took %v to time out", branch, elapsed)
+		}
+	}
+}
+
+func TestExtractStopsWhenCanceled(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "project.zip")
+	writeZip(t, archive, map[string]string{"package.json": `{}`})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := extractZip(ctx, archive, t.TempDir(), nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("extractZip() error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -2,23 +2,79 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
 
 	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
 	"github.com/google/uuid"
 	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
 )
 
+var (
+	// ErrNotFound is returned when the requested record does not exist.
+	ErrNotFound = errors.New("record not found")
+	// ErrTransient is returned when the database could not be reached or timed out.
+	// The lookup may succeed if retried later.
+	ErrTransient = errors.New("transient database error")
+)
+
+// classifyDBError wraps err with ErrNotFound or ErrTransient when it matches one of them.
+// Other errors (e.g. invalid queries) are returned with context only.
+func classifyDBError(entity string, id uuid.UUID, err error) error {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return fmt.Errorf("%s %s: %w", entity, id, ErrNotFound)
+	case isTransientDBError(err):
+		return fmt.Errorf("%s %s: %w: %w", entity, id, ErrTransient, err)
+	default:
+		return fmt.Errorf("%s %s: %w", entity, id, err)
+	}
+}
+
+// isTransientDBError reports whether err is caused by the connection to the database
+// rather than by the query itself.
+func isTransientDBError(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, sql.ErrConnDone) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	// Connection exceptions, insufficient resources, operator intervention and transaction rollbacks
+	// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+	var pgErr pgdriver.Error
+	if errors.As(err, &pgErr) {
+		code := pgErr.Field('C')
+		for _, class := range []string{"08", "53", "57", "40"} {
+			if strings.HasPrefix(code, class) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // getAnalysis retrieves an analysis from the database based on the provided analysisID.
 // It returns the retrieved analysis and an error if any occurred.
-func getAnalysis(db *bun.DB, analysisID uuid.UUID) (codeclarity.Analysis, error) {
+func getAnalysis(ctx context.Context, db *bun.DB, analysisID uuid.UUID) (codeclarity.Analysis, error) {
 
 	analysis_document := &codeclarity.Analysis{
 		Id: analysisID,
 	}
-	ctx := context.Background()
 	err := db.NewSelect().Model(analysis_document).WherePK().Scan(ctx)
 	if err != nil {
-		panic(err)
+		return codeclarity.Analysis{}, classifyDBError("analysis", analysisID, err)
 	}
 
 	return *analysis_document, nil
@@ -26,15 +82,14 @@ func getAnalysis(db *bun.DB, analysisID uuid.UUID) (codeclarity.Analysis, error)
 
 // getProject retrieves a project from the database based on the given projectID.
 // It returns the project document and an error if any occurred.
-func getProject(db *bun.DB, projectID uuid.UUID) (codeclarity.Project, error) {
+func getProject(ctx context.Context, db *bun.DB, projectID uuid.UUID) (codeclarity.Project, error) {
 
 	project_document := &codeclarity.Project{
 		Id: projectID,
 	}
-	ctx := context.Background()
 	err := db.NewSelect().Model(project_document).WherePK().Scan(ctx)
 	if err != nil {
-		panic(err)
+		return codeclarity.Project{}, classifyDBError("project", projectID, err)
 	}
 
 	return *project_document, nil
@@ -42,16 +97,39 @@ func getProject(db *bun.DB, projectID uuid.UUID) (codeclarity.Project, error) {
 
 // getIntegration retrieves an integration from the database based on the provided integrationID.
 // It returns the retrieved integration and an error if any occurred.
-func getIntegration(db *bun.DB, integrationID uuid.UUID) (codeclarity.Integration, error) {
+func getIntegration(ctx context.Context, db *bun.DB, integrationID uuid.UUID) (codeclarity.Integration, error) {
 
 	integration_document := &codeclarity.Integration{
 		Id: integrationID,
 	}
-	ctx := context.Background()
 	err := db.NewSelect().Model(integration_document).WherePK().Scan(ctx)
 	if err != nil {
-		panic(err)
+		return codeclarity.Integration{}, classifyDBError("integration", integrationID, err)
 	}
 
 	return *integration_document, nil
 }
+
+// saveDownloadedCommit records the commit an analysis was downloaded at in its downloaded_commit column,
+// replacing that of a previous download, so that branch analyses keep the revision they were run on.
+// The column is kept apart from the commit hash of the analysis, which is what the analysis requested
+// and decides the workspace it is downloaded into. It is added by a migration of the API,
+// see migrations/0001_analysis_downloaded_commit.sql.
+func saveDownloadedCommit(ctx context.Context, db *bun.DB, analysisID uuid.UUID, commit CommitInfo) error {
+	encoded, err := json.Marshal(commit)
+	if err != nil {
+		return fmt.Errorf("failed to encode the commit of analysis %s: %w", analysisID, err)
+	}
+	result, err := db.NewUpdate().
+		Model((*codeclarity.Analysis)(nil)).
+		Set("downloaded_commit = ?::jsonb", string(encoded)).
+		Where("id = ?", analysisID).
+		Exec(ctx)
+	if err != nil {
+		return classifyDBError("analysis", analysisID, err)
+	}
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return classifyDBError("analysis", analysisID, sql.ErrNoRows)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestClassifyDBError(t *testing.T) {
+	var tests = []struct {
+		name      string
+		err       error
+		notFound  bool
+		transient bool
+	}{
+		{"no rows", sql.ErrNoRows, true, false},
+		{"wrapped no rows", fmt.Errorf("scan: %w", sql.ErrNoRows), true, false},
+		{"deadline", context.DeadlineExceeded, false, true},
+		{"connection done", sql.ErrConnDone, false, true},
+		{"other", errors.New("syntax error"), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyDBError("analysis", uuid.New(), tt.err)
+			if errors.Is(err, ErrNotFound) != tt.notFound {
+				t.Errorf("errors.Is(%v, ErrNotFound) = %v, want %v", err, !tt.notFound, tt.notFound)
+			}
+			if errors.Is(err, ErrTransient) != tt.transient {
+				t.Errorf("errors.Is(%v, ErrTransient) = %v, want %v", err, !tt.transient, tt.transient)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// defaultWorkers is the number of downloads run at once when DOWNLOADER_WORKERS is not set.
+	defaultWorkers = 4
+	// defaultOrganizationConcurrency is the number of downloads of an organization run at once
+	// when DOWNLOADER_ORGANIZATION_CONCURRENCY is not set.
+	defaultOrganizationConcurrency = 2
+	// organizationRetryDelay is how long a message of an organization at its cap waits before being processed again.
+	organizationRetryDelay = 2 * time.Second
+	// reconnectDelay is how long the connections of keepConnected wait before reconnecting to the broker.
+	reconnectDelay = 10 * time.Second
+)
+
+// WorkerPoolConfig sizes the pool of workers processing dispatcher messages.
+type WorkerPoolConfig struct {
+	// Workers is the number of messages processed at once, which is also the prefetch of the consumer
+	Workers int
+	// OrganizationConcurrency caps the messages of a single organization processed at once,
+	// so that one organization cannot starve the others
+	OrganizationConcurrency int
+}
+
+// loadWorkerPoolConfig reads the WorkerPoolConfig from DOWNLOADER_WORKERS and DOWNLOADER_ORGANIZATION_CONCURRENCY.
+// Invalid values are logged and replaced by the defaults.
+func loadWorkerPoolConfig() WorkerPoolConfig {
+	return WorkerPoolConfig{
+		Workers:                 positiveEnv("DOWNLOADER_WORKERS", defaultWorkers),
+		OrganizationConcurrency: positiveEnv("DOWNLOADER_ORGANIZATION_CONCURRENCY", defaultOrganizationConcurrency),
+	}
+}
+
+// positiveEnv returns the positive integer in the environment variable name, or fallback.
+func positiveEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		log.Printf("Ignoring %s=%q: not a positive integer", name, value)
+		return fallback
+	}
+	return n
+}
+
+// organizationLimiter counts the messages of each organization being processed.
+type organizationLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	active map[uuid.UUID]int
+}
+
+// newOrganizationLimiter creates an organizationLimiter allowing limit messages per organization.
+func newOrganizationLimiter(limit int) *organizationLimiter {
+	return &organizationLimiter{limit: limit, active: make(map[uuid.UUID]int)}
+}
+
+// tryAcquire takes a slot of organization, reporting false if all of its slots are taken.
+func (l *organizationLimiter) tryAcquire(organization uuid.UUID) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[organization] >= l.limit {
+		return false
+	}
+	l.active[organization]++
+	return true
+}
+
+// release gives back a slot taken by tryAcquire.
+func (l *organizationLimiter) release(organization uuid.UUID) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[organization] <= 1 {
+		delete(l.active, organization)
+		return
+	}
+	l.active[organization]--
+}
+
+// workerPool processes deliveries concurrently with a fixed number of workers.
+// The handler is responsible for acknowledging the deliveries it processes.
+type workerPool struct {
+	config  WorkerPoolConfig
+	limiter *organizationLimiter
+	handler func(d amqp.Delivery)
+	// channelOpened, if set, is called with the channel of every connection of the consumer
+	channelOpened func(ch *amqp.Channel)
+	// postpone, if set, publishes d again to be delivered after organizationRetryDelay.
+	// Deliveries of organizations at their cap are postponed and acknowledged, freeing their prefetch slot.
+	postpone func(d amqp.Delivery) error
+	// recovered, if set, settles d once the handler panicked with err processing it.
+	// Otherwise d is rejected, as requeuing a message that keeps panicking would never end.
+	recovered func(d amqp.Delivery, err error)
+}
+
+// newWorkerPool creates a workerPool calling handler with the deliveries it is given.
+func newWorkerPool(config WorkerPoolConfig, handler func(d amqp.Delivery)) *workerPool {
+	return &workerPool{
+		config:  config,
+		limiter: newOrganizationLimiter(config.OrganizationConcurrency),
+		handler: handler,
+	}
+}
+
+// run processes deliveries until the channel is closed and every worker is done.
+func (p *workerPool) run(deliveries <-chan amqp.Delivery) {
+	var wg sync.WaitGroup
+	for i := 0; i < p.config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range deliveries {
+				p.process(d)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// process hands d to the handler, unless its organization already uses all of its slots.
+// Such deliveries are postponed by organizationRetryDelay, leaving the worker to other organizations.
+func (p *workerPool) process(d amqp.Delivery) {
+	organization := deliveryOrganization(d)
+	if !p.limiter.tryAcquire(organization) {
+		p.putBack(d, organization)
+		return
+	}
+	defer p.limiter.release(organization)
+
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("handler panicked: %v", r)
+			log.Printf("%v", err)
+			if p.recovered != nil {
+				p.recovered(d, err)
+			} else if err := d.Reject(false); err != nil {
+				log.Printf("Failed to reject message: %v", err)
+			}
+		}
+	}()
+	p.handler(d)
+}
+
+// putBack puts d, of an organization at its cap, back to be processed after organizationRetryDelay.
+// Without postpone, or if it fails, d is requeued once the delay is over and keeps its prefetch slot meanwhile.
+func (p *workerPool) putBack(d amqp.Delivery, organization uuid.UUID) {
+	if p.postpone != nil {
+		err := p.postpone(d)
+		if err == nil {
+			if err := d.Ack(false); err != nil {
+				log.Printf("Failed to acknowledge postponed message of organization %s: %v", organization, err)
+			}
+			return
+		}
+		log.Printf("Failed to postpone message of organization %s: %v", organization, err)
+	}
+	time.AfterFunc(organizationRetryDelay, func() {
+		if err := d.Nack(false, true); err != nil {
+			log.Printf("Failed to requeue message of organization %s: %v", organization, err)
+		}
+	})
+}
+
+// deliveryOrganization returns the organization a dispatcher message belongs to.
+// Malformed messages all share the nil organization.
+func deliveryOrganization(d amqp.Delivery) uuid.UUID {
+	var message struct {
+		OrganizationId uuid.UUID `json:"organization_id"`
+	}
+	if err := json.Unmarshal(d.Body, &message); err != nil {
+		return uuid.Nil
+	}
+	return message.OrganizationId
+}
+
+// consume processes the messages of queue with the pool, over a connection of its own to url
+// since the consumers of ServiceBase acknowledge messages themselves, one at a time.
+// It reconnects whenever the connection is lost and never returns.
+func (p *workerPool) consume(url string, queue string) {
+	keepConnected(url, "consumer of "+queue, func(ch *amqp.Channel) error {
+		return p.consumeOnce(ch, queue)
+	})
+}
+
+// keepConnected calls use with a channel on a connection of its own to url, as ServiceBase
+// neither exposes its connection nor publishes to exchanges. use returns once the connection is lost,
+// it is then called again on a new connection after reconnectDelay. keepConnected never returns.
+func keepConnected(url string, name string, use func(ch *amqp.Channel) error) {
+	for {
+		if err := connectOnce(url, use); err != nil {
+			log.Printf("The %s failed: %v", name, err)
+		}
+		log.Printf("Reconnecting the %s in %s", name, reconnectDelay)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// connectOnce calls use with a channel on a new connection to url, which is closed once use returns.
+func connectOnce(url string, use func(ch *amqp.Channel) error) error {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	return use(ch)
+}
+
+// consumeOnce processes the messages of queue until the connection of ch is lost.
+func (p *workerPool) consumeOnce(ch *amqp.Channel, queue string) error {
+	// Only take as many messages as there are workers, leaving the others to other replicas
+	if err := ch.Qos(p.config.Workers, 0, false); err != nil {
+		return fmt.Errorf("failed to set QoS: %w", err)
+	}
+	if _, err := ch.QueueDeclare(queue, true, false, false, false, nil); err != nil {
+		return fmt.Errorf("failed to declare queue: %w", err)
+	}
+	if p.channelOpened != nil {
+		p.channelOpened(ch)
+	}
+	deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to register consumer: %w", err)
+	}
+
+	log.Printf("Started listening on queue: %s with %d workers", queue, p.config.Workers)
+	p.run(deliveries)
+	return fmt.Errorf("consumer stopped")
+}
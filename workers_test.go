@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// recordingAcknowledger records how deliveries were acknowledged.
+type recordingAcknowledger struct {
+	mu      sync.Mutex
+	acks    []uint64
+	nacks   []uint64
+	rejects []uint64
+	nacked  chan uint64
+}
+
+func newRecordingAcknowledger() *recordingAcknowledger {
+	return &recordingAcknowledger{nacked: make(chan uint64, 16)}
+}
+
+func (a *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks = append(a.acks, tag)
+	return nil
+}
+
+func (a *recordingAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.mu.Lock()
+	a.nacks = append(a.nacks, tag)
+	a.mu.Unlock()
+	a.nacked <- tag
+	return nil
+}
+
+func (a *recordingAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rejects = append(a.rejects, tag)
+	return nil
+}
+
+// newDelivery returns a dispatcher message of organization acknowledged through acknowledger.
+func newDelivery(acknowledger amqp.Acknowledger, tag uint64, organization uuid.UUID) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger: acknowledger,
+		DeliveryTag:  tag,
+		Body:         []byte(fmt.Sprintf(`{"analysis_id":%q,"organization_id":%q}`, uuid.New(), organization)),
+	}
+}
+
+func TestLoadWorkerPoolConfig(t *testing.T) {
+	t.Setenv("DOWNLOADER_WORKERS", "8")
+	t.Setenv("DOWNLOADER_ORGANIZATION_CONCURRENCY", "-1")
+
+	config := loadWorkerPoolConfig()
+	if config.Workers != 8 {
+		t.Errorf("Workers = %d, want 8", config.Workers)
+	}
+	if config.OrganizationConcurrency != defaultOrganizationConcurrency {
+		t.Errorf("OrganizationConcurrency = %d, want %d", config.OrganizationConcurrency, defaultOrganizationConcurrency)
+	}
+}
+
+func TestOrganizationLimiter(t *testing.T) {
+	limiter := newOrganizationLimiter(2)
+	busy, other := uuid.New(), uuid.New()
+
+	if !limiter.tryAcquire(busy) || !limiter.tryAcquire(busy) {
+		t.Fatal("tryAcquire() refused a slot under the limit")
+	}
+	if limiter.tryAcquire(busy) {
+		t.Error("tryAcquire() granted a slot over the limit")
+	}
+	if !limiter.tryAcquire(other) {
+		t.Error("tryAcquire() refused a slot to another organization")
+	}
+	limiter.release(busy)
+	if !limiter.tryAcquire(busy) {
+		t.Error("tryAcquire() refused a released slot")
+	}
+}
+
+func TestWorkerPoolCapsOrganizations(t *testing.T) {
+	acknowledger := newRecordingAcknowledger()
+	busy, other := uuid.New(), uuid.New()
+
+	started := make(chan uint64, 16)
+	release := make(chan struct{})
+	pool := newWorkerPool(WorkerPoolConfig{Workers: 3, OrganizationConcurrency: 1}, func(d amqp.Delivery) {
+		started <- d.DeliveryTag
+		<-release
+		d.Ack(false)
+	})
+
+	deliveries := make(chan amqp.Delivery, 3)
+	deliveries <- newDelivery(acknowledger, 1, busy)
+	deliveries <- newDelivery(acknowledger, 2, busy)
+	deliveries <- newDelivery(acknowledger, 3, other)
+	close(deliveries)
+	done := make(chan struct{})
+	go func() {
+		pool.run(deliveries)
+		close(done)
+	}()
+
+	// Both organizations are processed at once, the second message of the busy one is requeued
+	processed := map[uint64]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case tag := <-started:
+			processed[tag] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages of different organizations were not processed concurrently")
+		}
+	}
+	if !processed[3] {
+		t.Errorf("processed %v, want the message of the other organization", processed)
+	}
+	select {
+	case tag := <-acknowledger.nacked:
+		if processed[tag] {
+			t.Errorf("message %d was both processed and requeued", tag)
+		}
+	case <-time.After(organizationRetryDelay + 5*time.Second):
+		t.Fatal("message over the organization cap was not requeued")
+	}
+
+	close(release)
+	<-done
+	if len(acknowledger.acks) != 2 {
+		t.Errorf("acknowledged %v, want 2 messages", acknowledger.acks)
+	}
+}
+
+func TestWorkerPoolPostponesCappedDeliveries(t *testing.T) {
+	acknowledger := newRecordingAcknowledger()
+	busy := uuid.New()
+
+	started := make(chan uint64, 16)
+	release := make(chan struct{})
+	postponed := make(chan uint64, 16)
+	pool := newWorkerPool(WorkerPoolConfig{Workers: 2, OrganizationConcurrency: 1}, func(d amqp.Delivery) {
+		started <- d.DeliveryTag
+		<-release
+		d.Ack(false)
+	})
+	pool.postpone = func(d amqp.Delivery) error {
+		postponed <- d.DeliveryTag
+		return nil
+	}
+
+	deliveries := make(chan amqp.Delivery, 2)
+	done := make(chan struct{})
+	go func() {
+		pool.run(deliveries)
+		close(done)
+	}()
+	deliveries <- newDelivery(acknowledger, 1, busy)
+	<-started
+	deliveries <- newDelivery(acknowledger, 2, busy)
+
+	// The message over the cap is handed over at once rather than holding its slot
+	select {
+	case tag := <-postponed:
+		if tag != 2 {
+			t.Errorf("postponed message %d, want 2", tag)
+		}
+	case <-time.After(organizationRetryDelay / 2):
+		t.Fatal("message over the organization cap was not postponed")
+	}
+	close(deliveries)
+	close(release)
+	<-done
+
+	if len(acknowledger.nacks) != 0 || !slices.Contains(acknowledger.acks, 2) {
+		t.Errorf("acks = %v, nacks = %v, want the postponed message acknowledged", acknowledger.acks, acknowledger.nacks)
+	}
+}
+
+func TestWorkerPoolSettlesPanics(t *testing.T) {
+	panicking := func(d amqp.Delivery) { panic("poison message") }
+
+	// Without a handler for panics, the message is dropped rather than redelivered forever
+	acknowledger := newRecordingAcknowledger()
+	newWorkerPool(WorkerPoolConfig{Workers: 1, OrganizationConcurrency: 1}, panicking).process(newDelivery(acknowledger, 1, uuid.New()))
+	if len(acknowledger.rejects) != 1 || len(acknowledger.nacks) != 0 {
+		t.Errorf("rejects = %v, nacks = %v, want the message rejected", acknowledger.rejects, acknowledger.nacks)
+	}
+
+	var recovered error
+	pool := newWorkerPool(WorkerPoolConfig{Workers: 1, OrganizationConcurrency: 1}, panicking)
+	pool.recovered = func(d amqp.Delivery, err error) { recovered = err }
+	pool.process(newDelivery(newRecordingAcknowledger(), 1, uuid.New()))
+	if recovered == nil || !strings.Contains(recovered.Error(), "poison message") {
+		t.Errorf("recovered %v, want the panic", recovered)
+	}
+}
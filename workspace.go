@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+// defaultDownloadPath is used when DOWNLOAD_PATH is not set.
+const defaultDownloadPath = "/private"
+
+// ErrInvalidRef is returned for branches and commits that cannot be used to download a project.
+var ErrInvalidRef = errors.New("invalid ref")
+
+// commitPattern matches abbreviated and full SHA-1 or SHA-256 object names.
+var commitPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,64}$`)
+
+const (
+	// commitRefPrefix begins the refs of the workspaces of commits.
+	commitRefPrefix = "commit-"
+	// branchRefPrefix begins the refs of the workspaces of branches,
+	// which may be named like a commit but must not share its workspace.
+	branchRefPrefix = "branch-"
+)
+
+// WorkspaceLayout decides where the sources of an analysis are downloaded.
+// Workspaces follow the {root}/{organization}/projects/{project}/{ref} scheme,
+// which is shared by every fetcher, the language detection and the downstream plugins.
+// The ref is "commit-<hash>" or "branch-<name>", encoded with encodeRef so that it is always a single path segment.
+type WorkspaceLayout struct {
+	// Root is the download root, which also holds the uploaded archives
+	Root string
+}
+
+// NewWorkspaceLayout creates a WorkspaceLayout rooted at DOWNLOAD_PATH.
+func NewWorkspaceLayout() WorkspaceLayout {
+	root := os.Getenv("DOWNLOAD_PATH")
+	if root == "" {
+		root = defaultDownloadPath
+	}
+	return WorkspaceLayout{Root: root}
+}
+
+// OrganizationRoot returns the directory holding every file of an organization.
+func (l WorkspaceLayout) OrganizationRoot(organization uuid.UUID) string {
+	return filepath.Join(l.Root, organization.String())
+}
+
+// ProjectRoot returns the directory holding every workspace of a project.
+func (l WorkspaceLayout) ProjectRoot(organization uuid.UUID, project uuid.UUID) string {
+	return filepath.Join(l.OrganizationRoot(organization), "projects", project.String())
+}
+
+// MirrorPath returns the bare repository shared by the workspaces of a project cloned with CloneMirror.
+// Its name begins with '.', which encodeRef always encodes, so it never collides with a workspace.
+func (l WorkspaceLayout) MirrorPath(organization uuid.UUID, project uuid.UUID) string {
+	return filepath.Join(l.ProjectRoot(organization, project), ".mirror.git")
+}
+
+// referencesPath returns the directory recording which analyses use the workspaces of a project.
+func (l WorkspaceLayout) referencesPath(organization uuid.UUID, project uuid.UUID) string {
+	return filepath.Join(l.ProjectRoot(organization, project), ".references")
+}
+
+// AddReference records that analysis uses the workspace of a project at ref,
+// so that it is only removed once every analysis using it was deleted.
+func (l WorkspaceLayout) AddReference(organization uuid.UUID, project uuid.UUID, ref string, analysis uuid.UUID) error {
+	dir := filepath.Join(l.referencesPath(organization, project), encodeRef(ref))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create references directory: %w", err)
+	}
+	return os.WriteFile(filepath.Join(dir, analysis.String()), nil, 0644)
+}
+
+// ReleaseReferences drops the references of analysis to the workspaces of a project.
+// It returns the refs of the workspaces no analysis uses anymore.
+func (l WorkspaceLayout) ReleaseReferences(organization uuid.UUID, project uuid.UUID, analysis uuid.UUID) ([]string, error) {
+	root := l.referencesPath(organization, project)
+	markers, err := filepath.Glob(filepath.Join(root, "*", analysis.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, marker := range markers {
+		if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+			return orphans, fmt.Errorf("failed to release reference: %w", err)
+		}
+		dir := filepath.Dir(marker)
+		// Removing the directory fails while other analyses reference the workspace
+		if err := os.Remove(dir); err != nil {
+			continue
+		}
+		ref, err := decodeRef(filepath.Base(dir))
+		if err != nil {
+			return orphans, fmt.Errorf("invalid references directory %s: %w", dir, err)
+		}
+		orphans = append(orphans, ref)
+	}
+	return orphans, nil
+}
+
+// IsReferenced reports whether an analysis uses the workspace of a project at ref.
+func (l WorkspaceLayout) IsReferenced(organization uuid.UUID, project uuid.UUID, ref string) bool {
+	_, err := os.Stat(filepath.Join(l.referencesPath(organization, project), encodeRef(ref)))
+	return err == nil
+}
+
+// DiagnosticsPath returns the file keeping the output of the download of an analysis.
+func (l WorkspaceLayout) DiagnosticsPath(organization uuid.UUID, analysis uuid.UUID) string {
+	return filepath.Join(l.OrganizationRoot(organization), "downloads", analysis.String()+".log")
+}
+
+// OpenDiagnostics creates or truncates the diagnostics file of an analysis.
+func (l WorkspaceLayout) OpenDiagnostics(organization uuid.UUID, analysis uuid.UUID) (*os.File, error) {
+	path := l.DiagnosticsPath(organization, analysis)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create diagnostics directory: %w", err)
+	}
+	return os.Create(path)
+}
+
+// Path returns the workspace of a project checked out at ref.
+// It fails if the resulting path would not be a direct child of the project root.
+func (l WorkspaceLayout) Path(organization uuid.UUID, project uuid.UUID, ref string) (string, error) {
+	projectRoot := l.ProjectRoot(organization, project)
+	path := filepath.Join(projectRoot, encodeRef(ref))
+
+	if filepath.Dir(path) != projectRoot {
+		return "", fmt.Errorf("%w: workspace for %q escapes %s", ErrInvalidRef, ref, projectRoot)
+	}
+	return path, nil
+}
+
+// Workspace returns the ref a fetch request is downloaded at and the path of its workspace.
+// Invalid refs are reported as a DownloadError.
+func (l WorkspaceLayout) Workspace(req FetchRequest) (string, string, error) {
+	ref, err := workspaceRef(req.Analysis)
+	if err != nil {
+		return "", "", newDownloadError(StageLookup, CodeInvalidRef, err)
+	}
+	path, err := l.Path(req.Organization, req.Project.Id, ref)
+	if err != nil {
+		return "", "", newDownloadError(StageLookup, CodeInvalidRef, err)
+	}
+	return ref, path, nil
+}
+
+// workspaceRef returns the ref an analysis is downloaded at: its commit if set,
+// otherwise its branch, defaulting to "main".
+// Commits and branches are told apart by commitRef and branchRef.
+// It fails if the ref is not a valid commit or branch name.
+func workspaceRef(analysis codeclarity.Analysis) (string, error) {
+	if commit := strings.TrimSpace(analysis.Commit); commit != "" {
+		if !commitPattern.MatchString(commit) {
+			return "", fmt.Errorf("%w: %q is not a commit hash", ErrInvalidRef, commit)
+		}
+		return commitRef(commit), nil
+	}
+	if analysis.Branch != "" {
+		if err := validateBranch(analysis.Branch); err != nil {
+			return "", err
+		}
+		return branchRef(analysis.Branch), nil
+	}
+	return branchRef("main"), nil
+}
+
+// commitRef returns the ref of the workspace of commit.
+// Hashes are lower-cased, so that a commit has a single workspace whatever the case it is given in.
+func commitRef(commit string) string {
+	return commitRefPrefix + strings.ToLower(commit)
+}
+
+// branchRef returns the ref of the workspace of branch.
+func branchRef(branch string) string {
+	return branchRefPrefix + branch
+}
+
+// validateBranch checks a branch name against the rules of `git check-ref-format --branch`.
+// See https://git-scm.com/docs/git-check-ref-format
+func validateBranch(branch string) error {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w: branch %q %s", ErrInvalidRef, branch, reason)
+	}
+
+	switch {
+	case branch == "@":
+		return invalid("cannot be @")
+	case strings.HasPrefix(branch, "-"):
+		return invalid("cannot begin with -")
+	case strings.HasPrefix(branch, "/") || strings.HasSuffix(branch, "/"):
+		return invalid("cannot begin or end with /")
+	case strings.HasSuffix(branch, "."):
+		return invalid("cannot end with .")
+	case strings.Contains(branch, ".."):
+		return invalid("cannot contain ..")
+	case strings.Contains(branch, "//"):
+		return invalid("cannot contain //")
+	case strings.Contains(branch, "@{"):
+		return invalid("cannot contain @{")
+	}
+
+	for _, r := range branch {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(" ~^:?*[\\", r) {
+			return invalid(fmt.Sprintf("cannot contain %q", r))
+		}
+	}
+
+	for _, component := range strings.Split(branch, "/") {
+		if strings.HasPrefix(component, ".") {
+			return invalid("components cannot begin with .")
+		}
+		if strings.HasSuffix(component, ".lock") {
+			return invalid("components cannot end with .lock")
+		}
+	}
+	return nil
+}
+
+// encodeRef turns a ref into a single path segment.
+// Bytes other than ASCII letters, digits, '-', '_' and '.' are percent-encoded, as is a leading '.',
+// so distinct refs never map to the same directory and never to "." or "..".
+// The encoding is reversed by decodeRef.
+func encodeRef(ref string) string {
+	var b strings.Builder
+	for i := 0; i < len(ref); i++ {
+		c := ref[i]
+		if isUnreservedRefByte(c) && !(i == 0 && c == '.') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// decodeRef returns the ref encoded in a path segment by encodeRef.
+func decodeRef(segment string) (string, error) {
+	return url.PathUnescape(segment)
+}
+
+// isUnreservedRefByte reports whether c is kept as is by encodeRef.
+func isUnreservedRefByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.'
+}
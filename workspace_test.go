@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	codeclarity "github.com/CodeClarityCE/utility-types/codeclarity_db"
+	"github.com/google/uuid"
+)
+
+func TestValidateBranch(t *testing.T) {
+	var tests = []struct {
+		branch string
+		valid  bool
+	}{
+		{"main", true},
+		{"feature/login", true},
+		{"release-1.2", true},
+		{"feature%2Flogin", true},
+		{"../../other-org", false},
+		{"feature/../main", false},
+		{"-delete", false},
+		{"/main", false},
+		{"main/", false},
+		{"main.", false},
+		{"feature//login", false},
+		{".hidden", false},
+		{"feature/.hidden", false},
+		{"main.lock", false},
+		{"@", false},
+		{"main@{1}", false},
+		{"with space", false},
+		{"tilde~1", false},
+		{"caret^", false},
+		{"colon:", false},
+		{"glob*", false},
+		{"back\\slash", false},
+		{"ctrl\x01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.branch, func(t *testing.T) {
+			err := validateBranch(tt.branch)
+			if (err == nil) != tt.valid {
+				t.Errorf("validateBranch(%q) = %v, want valid=%v", tt.branch, err, tt.valid)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidRef) {
+				t.Errorf("validateBranch(%q) = %v, want ErrInvalidRef", tt.branch, err)
+			}
+		})
+	}
+}
+
+func TestWorkspaceRef(t *testing.T) {
+	var tests = []struct {
+		name     string
+		analysis codeclarity.Analysis
+		ref      string
+		valid    bool
+	}{
+		{"default", codeclarity.Analysis{}, "branch-main", true},
+		{"branch", codeclarity.Analysis{Branch: "feature/login"}, "branch-feature/login", true},
+		{"blank commit", codeclarity.Analysis{Branch: "dev", Commit: " "}, "branch-dev", true},
+		{"commit", codeclarity.Analysis{Branch: "dev", Commit: "4b825dc"}, "commit-4b825dc", true},
+		{"uppercase commit", codeclarity.Analysis{Commit: "4B825DC"}, "commit-4b825dc", true},
+		{"hex branch", codeclarity.Analysis{Branch: "deadbeef"}, "branch-deadbeef", true},
+		{"invalid commit", codeclarity.Analysis{Commit: "../4b825dc"}, "", false},
+		{"invalid branch", codeclarity.Analysis{Branch: "../../other-org"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := workspaceRef(tt.analysis)
+			if (err == nil) != tt.valid {
+				t.Fatalf("workspaceRef() error = %v, want valid=%v", err, tt.valid)
+			}
+			if ref != tt.ref {
+				t.Errorf("workspaceRef() = %q, want %q", ref, tt.ref)
+			}
+		})
+	}
+}
+
+func TestEncodeRefRoundTrip(t *testing.T) {
+	for _, ref := range []string{"main", "feature/login", "feature%2Flogin", ".", "..", "..%", "ünïcode", "a b/c"} {
+		segment := encodeRef(ref)
+		if strings.Contains(segment, "/") || segment == "." || segment == ".." || strings.HasPrefix(segment, ".") {
+			t.Errorf("encodeRef(%q) = %q, not a safe path segment", ref, segment)
+		}
+		decoded, err := decodeRef(segment)
+		if err != nil || decoded != ref {
+			t.Errorf("decodeRef(encodeRef(%q)) = %q, %v", ref, decoded, err)
+		}
+	}
+}
+
+func TestWorkspacesDoNotOverlap(t *testing.T) {
+	layout := WorkspaceLayout{Root: "/private"}
+	organization := uuid.New()
+	project := uuid.New()
+	organizationRoot := layout.OrganizationRoot(organization) + string(filepath.Separator)
+
+	refs := []string{"feature", "feature/login", "feature-login", "feature%2Flogin", "feature_login", "Feature", "4b825dc"}
+	paths := make(map[string]string)
+	for _, ref := range refs {
+		path, err := layout.Path(organization, project, ref)
+		if err != nil {
+			t.Fatalf("Path(%q) error = %v", ref, err)
+		}
+		if !strings.HasPrefix(path, organizationRoot) {
+			t.Errorf("Path(%q) = %q escapes %q", ref, path, organizationRoot)
+		}
+		for other, otherPath := range paths {
+			if path == otherPath || strings.HasPrefix(path, otherPath+string(filepath.Separator)) || strings.HasPrefix(otherPath, path+string(filepath.Separator)) {
+				t.Errorf("workspaces of %q (%s) and %q (%s) overlap", ref, path, other, otherPath)
+			}
+		}
+		paths[ref] = path
+	}
+}
+
+func TestCommitAndBranchWorkspacesDoNotCollide(t *testing.T) {
+	layout := WorkspaceLayout{Root: "/private"}
+	project := codeclarity.Project{Id: uuid.New()}
+	workspace := func(analysis codeclarity.Analysis) string {
+		_, path, err := layout.Workspace(FetchRequest{Analysis: analysis, Project: project, Organization: uuid.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Base(path)
+	}
+
+	// A branch named like a commit gets a workspace of its own
+	if branch, commit := workspace(codeclarity.Analysis{Branch: "deadbeef"}), workspace(codeclarity.Analysis{Commit: "deadbeef"}); branch == commit {
+		t.Errorf("branch deadbeef and commit deadbeef share the workspace %s", branch)
+	}
+	// A commit has the same workspace whatever its case
+	if upper, lower := workspace(codeclarity.Analysis{Commit: "ABC1"}), workspace(codeclarity.Analysis{Commit: "abc1"}); upper != lower {
+		t.Errorf("commits ABC1 and abc1 have the workspaces %s and %s, want the same", upper, lower)
+	}
+}
+
+func TestPathRejectsEmptyRef(t *testing.T) {
+	layout := WorkspaceLayout{Root: "/private"}
+	if _, err := layout.Path(uuid.New(), uuid.New(), ""); !errors.Is(err, ErrInvalidRef) {
+		t.Errorf("Path(\"\") error = %v, want ErrInvalidRef", err)
+	}
+}